@@ -0,0 +1,938 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokChar
+	tokPunct
+	tokDirective // a whole preprocessor line, without the #
+)
+
+type token struct {
+	kind    tokenKind
+	text    string
+	line    int
+	comment []string // the comment block just before the token, as Go comment lines
+}
+
+// puncts are the punctuators longer than one byte, longest first.
+var puncts = []string{
+	"...", "<<=", ">>=",
+	"->", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "##",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=",
+}
+
+// lexer splits C source into tokens.
+type lexer struct {
+	name string
+	src  string
+	pos  int
+	line int
+	bol  bool // nothing but white space since the start of the line
+
+	comment    []string // comment block waiting for a token to attach to
+	commentEnd int      // the line it ended on
+	lastLine   int      // the line the last token was on
+}
+
+// lex splits src, which starts at line of the file name, into tokens ending
+// with a tokEOF.
+func lex(name, src string, line int) ([]token, error) {
+	l := &lexer{name: name, src: strings.Replace(src, "\r\n", "\n", -1), line: line, bol: true}
+	var toks []token
+
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		toks = append(toks, t)
+		if t.kind == tokEOF {
+			return toks, nil
+		}
+	}
+}
+
+func (l *lexer) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", l.name, l.line, fmt.Sprintf(format, a...))
+}
+
+func (l *lexer) peek(n int) byte {
+	if l.pos+n < len(l.src) {
+		return l.src[l.pos+n]
+	}
+	return 0
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		rest := l.src[l.pos:]
+		c := rest[0]
+
+		switch {
+		case c == '\n':
+			l.pos++
+			l.line++
+			l.bol = true
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.pos++
+		case c == '\\' && l.peek(1) == '\n':
+			l.pos += 2
+			l.line++
+		case prefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			l.addComment(l.line, l.line, []string{strings.TrimRight(rest[:end], " \t")})
+			l.pos += end
+		case prefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return token{}, l.errorf("unterminated comment")
+			}
+			text := rest[:end+4]
+			start := l.line
+			l.line += strings.Count(text, "\n")
+			l.pos += len(text)
+			l.addComment(start, l.line, blockComment(text))
+		case c == '#' && l.bol:
+			return l.directive(), nil
+		default:
+			return l.token()
+		}
+	}
+
+	return l.emit(tokEOF, ""), nil
+}
+
+// addComment adds lines, a comment from line start to end, to the block
+// waiting for the next token. A comment after a token on the same line
+// belongs to that token and is dropped; a blank line starts a new block.
+func (l *lexer) addComment(start, end int, lines []string) {
+	if start == l.lastLine {
+		return
+	}
+	if l.comment != nil && start > l.commentEnd+1 {
+		l.comment = nil
+	}
+	l.comment = append(l.comment, lines...)
+	l.commentEnd = end
+}
+
+// blockComment turns a /* */ comment into // lines.
+func blockComment(text string) []string {
+	body := strings.TrimLeft(text[2:len(text)-2], "*!")
+
+	var lines []string
+	for _, line := range split(body, "\n") {
+		line = trim(line)
+		if prefix(line, "*") {
+			line = trim(strings.TrimLeft(line, "*"))
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i, line := range lines {
+		lines[i] = strings.TrimRight("// "+line, " ")
+	}
+	return lines
+}
+
+// emit makes a token starting on the current line, attaching the comment
+// block immediately before it.
+func (l *lexer) emit(kind tokenKind, text string) token {
+	t := token{kind: kind, text: text, line: l.line}
+	if l.comment != nil && l.commentEnd >= l.line-1 {
+		t.comment = l.comment
+	}
+	l.comment = nil
+	l.bol = false
+	l.lastLine = l.line
+	return t
+}
+
+// directive reads a preprocessor line, joining continued lines and dropping
+// comments.
+func (l *lexer) directive() token {
+	t := l.emit(tokDirective, "")
+	l.pos++
+
+	var b bytes.Buffer
+	for l.pos < len(l.src) {
+		rest := l.src[l.pos:]
+		c := rest[0]
+
+		if c == '\n' {
+			break
+		}
+
+		switch {
+		case c == '\\' && l.peek(1) == '\n':
+			l.pos += 2
+			l.line++
+			b.WriteByte(' ')
+		case prefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			l.pos += end
+		case prefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				end = len(rest) - 4
+			}
+			l.line += strings.Count(rest[:end+4], "\n")
+			l.pos += end + 4
+			b.WriteByte(' ')
+		case c == '"' || c == '\'':
+			n, ok := quoted(rest)
+			if !ok {
+				n = 1
+			}
+			b.WriteString(rest[:n])
+			l.pos += n
+		default:
+			b.WriteByte(c)
+			l.pos++
+		}
+	}
+
+	t.text = trim(b.String())
+	return t
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '$'
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdent(c byte) bool { return isIdentStart(c) || isDigit(c) }
+
+// quoted returns the length of the string or character literal s starts
+// with.
+func quoted(s string) (int, bool) {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case q:
+			return i + 1, true
+		case '\n':
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+func (l *lexer) token() (token, error) {
+	s := l.src[l.pos:]
+	c := s[0]
+	kind := tokPunct
+	n := 1
+
+	switch {
+	case isIdentStart(c):
+		for n < len(s) && isIdent(s[n]) {
+			n++
+		}
+		kind = tokIdent
+
+		// L"wide" and the like
+		if p := s[:n]; n < len(s) && (s[n] == '"' || s[n] == '\'') && (p == "L" || p == "u" || p == "U" || p == "u8") {
+			m, ok := quoted(s[n:])
+			if !ok {
+				return token{}, l.errorf("unterminated literal")
+			}
+			n += m
+			kind = tokString
+			if s[n-1] == '\'' {
+				kind = tokChar
+			}
+		}
+	case isDigit(c) || c == '.' && len(s) > 1 && isDigit(s[1]):
+		for n < len(s) && (isIdent(s[n]) || s[n] == '.' || (s[n] == '+' || s[n] == '-') && strings.IndexByte("eEpP", s[n-1]) >= 0) {
+			n++
+		}
+		kind = tokNumber
+	case c == '"' || c == '\'':
+		var ok bool
+		if n, ok = quoted(s); !ok {
+			return token{}, l.errorf("unterminated literal")
+		}
+		kind = tokString
+		if c == '\'' {
+			kind = tokChar
+		}
+	default:
+		for _, p := range puncts {
+			if prefix(s, p) {
+				n = len(p)
+				break
+			}
+		}
+	}
+
+	t := l.emit(kind, s[:n])
+	l.pos += n
+	return t, nil
+}
+
+// macro is a #define.
+type macro struct {
+	name    string
+	fn      bool     // takes arguments
+	params  []string // the last is __VA_ARGS__ for a variadic macro
+	body    []token
+	line    int
+	comment []string
+}
+
+// cond is an #if block.
+type cond struct {
+	active bool // the current branch is being read
+	done   bool // some branch has been taken
+	outer  bool // the enclosing block is being read
+}
+
+// preprocessor follows #if blocks and expands macros, as far as can be done
+// without reading other headers: #include is ignored.
+type preprocessor struct {
+	name    string
+	macros  map[string]*macro
+	conds   []cond
+	defined []*macro // by the header, in order
+}
+
+func newPreprocessor(name string, defines map[string]string) (*preprocessor, error) {
+	p := &preprocessor{name: name, macros: map[string]*macro{}}
+
+	for k, v := range defines {
+		toks, err := lex("-D "+k, v, 1)
+		if err != nil {
+			return nil, err
+		}
+		p.macros[k] = &macro{name: k, body: toks[:len(toks)-1]}
+	}
+
+	return p, nil
+}
+
+func (p *preprocessor) active() bool {
+	return len(p.conds) == 0 || p.conds[len(p.conds)-1].active
+}
+
+func (p *preprocessor) errorf(line int, format string, a ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.name, line, fmt.Sprintf(format, a...))
+}
+
+// process runs toks through the preprocessor, returning what the compiler
+// would see.
+func (p *preprocessor) process(toks []token) ([]token, error) {
+	var out, run []token
+
+	for _, t := range toks {
+		switch {
+		case t.kind == tokDirective:
+			out = append(out, p.expand(run, nil)...)
+			run = nil
+			if err := p.directive(t); err != nil {
+				return nil, err
+			}
+		case t.kind == tokEOF:
+			if len(p.conds) > 0 {
+				return nil, p.errorf(t.line, "missing #endif")
+			}
+			out = append(out, p.expand(run, nil)...)
+			out = append(out, t)
+		case p.active():
+			run = append(run, t)
+		}
+	}
+
+	return out, nil
+}
+
+func (p *preprocessor) directive(t token) error {
+	toks, err := lex(p.name, t.text, t.line)
+	if err != nil {
+		return err
+	}
+	toks = toks[:len(toks)-1]
+	if len(toks) == 0 {
+		return nil
+	}
+	name, args := toks[0].text, toks[1:]
+
+	switch name {
+	case "ifdef", "ifndef":
+		if len(args) == 0 || args[0].kind != tokIdent {
+			return p.errorf(t.line, "#%s needs a name", name)
+		}
+		_, v := p.macros[args[0].text]
+		p.push(v == (name == "ifdef"))
+		return nil
+	case "if":
+		v := false
+		if p.active() {
+			if v, err = p.cond(args); err != nil {
+				return p.errorf(t.line, "#if: %s", err)
+			}
+		}
+		p.push(v)
+		return nil
+	case "elif", "else", "endif":
+		if len(p.conds) == 0 {
+			return p.errorf(t.line, "#%s without #if", name)
+		}
+		c := &p.conds[len(p.conds)-1]
+		switch name {
+		case "elif":
+			c.active = false
+			if c.outer && !c.done {
+				if c.active, err = p.cond(args); err != nil {
+					return p.errorf(t.line, "#elif: %s", err)
+				}
+				c.done = c.active
+			}
+		case "else":
+			c.active = c.outer && !c.done
+			c.done = true
+		case "endif":
+			p.conds = p.conds[:len(p.conds)-1]
+		}
+		return nil
+	}
+
+	if !p.active() {
+		return nil
+	}
+
+	switch name {
+	case "define":
+		return p.define(t, args)
+	case "undef":
+		if len(args) > 0 {
+			delete(p.macros, args[0].text)
+		}
+	case "error":
+		fmt.Fprintf(os.Stderr, "WARN (%s:%d) %s\n", p.name, t.line, t.text)
+	}
+
+	// #include, #pragma, #line and so on don't matter here
+	return nil
+}
+
+func (p *preprocessor) push(v bool) {
+	outer := p.active()
+	p.conds = append(p.conds, cond{active: outer && v, done: v, outer: outer})
+}
+
+func (p *preprocessor) define(t token, args []token) error {
+	if len(args) == 0 || args[0].kind != tokIdent {
+		return p.errorf(t.line, "#define needs a name")
+	}
+	m := &macro{name: args[0].text, line: t.line, comment: t.comment}
+	body := args[1:]
+
+	// only a ( straight after the name makes a function-like macro
+	rest := trim(strings.TrimPrefix(t.text, "define"))
+	if len(body) > 0 && body[0].text == "(" && prefix(rest, m.name+"(") {
+		m.fn = true
+		i := 1
+		for ; i < len(body) && body[i].text != ")"; i++ {
+			switch body[i].text {
+			case ",":
+			case "...":
+				m.params = append(m.params, "__VA_ARGS__")
+			default:
+				m.params = append(m.params, body[i].text)
+			}
+		}
+		if i == len(body) {
+			return p.errorf(t.line, "missing ) in parameters of %s", m.name)
+		}
+		body = body[i+1:]
+	}
+
+	m.body = body
+	p.macros[m.name] = m
+	p.defined = append(p.defined, m)
+	return nil
+}
+
+// defines returns the object-like macros the header leaves defined.
+func (p *preprocessor) defines() []*Define {
+	var ds []*Define
+	for _, m := range p.defined {
+		if m.fn || p.macros[m.name] != m {
+			continue
+		}
+		ds = append(ds, &Define{
+			Name:     m.name,
+			Value:    joinTokens(m.body),
+			Expanded: joinTokens(p.expand(m.body, map[string]bool{m.name: true})),
+			Comment:  m.comment,
+			Line:     m.line,
+		})
+	}
+	return ds
+}
+
+// expand replaces the macros in toks other than those in hide, which are
+// being expanded already.
+func (p *preprocessor) expand(toks []token, hide map[string]bool) []token {
+	var out []token
+	var carry []string // comment of a macro that expanded to nothing
+
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		m := p.macros[t.text]
+		if t.kind != tokIdent || m == nil || hide[t.text] {
+			if carry != nil && t.comment == nil {
+				t.comment, carry = carry, nil
+			}
+			out = append(out, t)
+			continue
+		}
+
+		body := m.body
+		if m.fn {
+			args, n, ok := macroArgs(toks[i+1:])
+			if !ok {
+				out = append(out, t)
+				continue
+			}
+			body = m.substitute(args)
+			i += n
+		}
+
+		inner := map[string]bool{m.name: true}
+		for k := range hide {
+			inner[k] = true
+		}
+
+		// the expansion stands where the macro was
+		var exp []token
+		for _, b := range body {
+			b.line = t.line
+			b.comment = nil
+			exp = append(exp, b)
+		}
+		exp = p.expand(exp, inner)
+
+		c := t.comment
+		if c == nil {
+			c = carry
+		}
+		if len(exp) == 0 {
+			carry = c
+			continue
+		}
+		exp[0].comment, carry = c, nil
+		out = append(out, exp...)
+	}
+
+	return out
+}
+
+// macroArgs reads the arguments of a function-like macro from toks, which
+// should start with the (, and returns them and how many tokens they took.
+func macroArgs(toks []token) (args [][]token, n int, ok bool) {
+	if len(toks) == 0 || toks[0].text != "(" {
+		return nil, 0, false
+	}
+
+	depth := 0
+	var arg []token
+	for i, t := range toks {
+		switch t.text {
+		case "(", "[", "{":
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ")", "]", "}":
+			depth--
+			if depth == 0 {
+				return append(args, arg), i + 1, true
+			}
+		case ",":
+			if depth == 1 {
+				args = append(args, arg)
+				arg = nil
+				continue
+			}
+		}
+		arg = append(arg, t)
+	}
+
+	return nil, 0, false
+}
+
+// substitute returns the body of m with args in place of its parameters.
+func (m *macro) substitute(args [][]token) []token {
+	if len(args) == 1 && len(args[0]) == 0 && len(m.params) == 0 {
+		args = nil
+	}
+
+	// the variadic parameter takes what is left, commas and all
+	if n := len(m.params); n > 0 && m.params[n-1] == "__VA_ARGS__" && len(args) > n {
+		va := args[n-1]
+		for _, a := range args[n:] {
+			va = append(append(va, token{kind: tokPunct, text: ","}), a...)
+		}
+		args = append(args[:n-1], va)
+	}
+
+	arg := func(name string) ([]token, bool) {
+		for i, p := range m.params {
+			if p == name {
+				if i < len(args) {
+					return args[i], true
+				}
+				return nil, true
+			}
+		}
+		return nil, false
+	}
+
+	var out []token
+	for i := 0; i < len(m.body); i++ {
+		t := m.body[i]
+
+		switch {
+		case t.text == "#" && i+1 < len(m.body):
+			if a, ok := arg(m.body[i+1].text); ok {
+				out = append(out, token{kind: tokString, text: strconv.Quote(joinTokens(a))})
+				i++
+				continue
+			}
+		case t.text == "##" && len(out) > 0 && i+1 < len(m.body):
+			next := []token{m.body[i+1]}
+			if a, ok := arg(next[0].text); ok {
+				next = a
+			}
+			i++
+			if len(next) > 0 {
+				last := &out[len(out)-1]
+				last.text += next[0].text
+				if last.kind == tokPunct {
+					last.kind = next[0].kind
+				}
+				out = append(out, next[1:]...)
+			}
+			continue
+		case t.kind == tokIdent:
+			if a, ok := arg(t.text); ok {
+				out = append(out, a...)
+				continue
+			}
+		}
+
+		out = append(out, t)
+	}
+
+	return out
+}
+
+// joinTokens spells toks out again, with spaces only where they are needed.
+func joinTokens(toks []token) string {
+	var b bytes.Buffer
+	for i, t := range toks {
+		if i > 0 {
+			prev := toks[i-1]
+			if prev.kind != tokPunct && t.kind != tokPunct || t.text == "{" || prev.text == "," {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// cond evaluates the condition of an #if or #elif.
+func (p *preprocessor) cond(toks []token) (bool, error) {
+	// defined must be seen to before anything is expanded
+	var in []token
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if t.text != "defined" {
+			in = append(in, t)
+			continue
+		}
+
+		var name string
+		switch {
+		case i+1 < len(toks) && toks[i+1].kind == tokIdent:
+			name = toks[i+1].text
+			i++
+		case i+3 < len(toks) && toks[i+1].text == "(" && toks[i+3].text == ")":
+			name = toks[i+2].text
+			i += 3
+		default:
+			return false, fmt.Errorf("bad use of defined")
+		}
+
+		v := "0"
+		if _, ok := p.macros[name]; ok {
+			v = "1"
+		}
+		in = append(in, token{kind: tokNumber, text: v, line: t.line})
+	}
+
+	v, err := evalExpr(p.expand(in, nil), nil)
+	return v != 0, err
+}
+
+// exprParser evaluates constant integer expressions, as found in #if and
+// enums.
+type exprParser struct {
+	toks  []token
+	pos   int
+	ident func(name string) (int64, bool) // value of a name, if it has one
+}
+
+// binaryPrec is how tightly each binary operator binds.
+var binaryPrec = map[string]int{
+	"*": 10, "/": 10, "%": 10,
+	"+": 9, "-": 9,
+	"<<": 8, ">>": 8,
+	"<": 7, "<=": 7, ">": 7, ">=": 7,
+	"==": 6, "!=": 6,
+	"&":  5,
+	"^":  4,
+	"|":  3,
+	"&&": 2,
+	"||": 1,
+}
+
+// evalExpr evaluates the expression toks. Names are looked up with ident; if
+// it is nil they are 0, as in #if.
+func evalExpr(toks []token, ident func(string) (int64, bool)) (v int64, err error) {
+	e := &exprParser{toks: toks, ident: ident}
+
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(exprError)
+			if !ok {
+				panic(r)
+			}
+			v, err = 0, pe
+		}
+	}()
+
+	v = e.ternary()
+	if e.pos < len(e.toks) {
+		e.fail("unexpected %s", e.toks[e.pos].text)
+	}
+	return v, nil
+}
+
+type exprError string
+
+func (e exprError) Error() string { return string(e) }
+
+func (e *exprParser) fail(format string, a ...interface{}) {
+	panic(exprError(fmt.Sprintf(format, a...)))
+}
+
+func (e *exprParser) peek() string {
+	if e.pos < len(e.toks) {
+		return e.toks[e.pos].text
+	}
+	return ""
+}
+
+func (e *exprParser) ternary() int64 {
+	c := e.binary(1)
+	if e.peek() != "?" {
+		return c
+	}
+	e.pos++
+	a := e.ternary()
+	if e.peek() != ":" {
+		e.fail("missing : after ?")
+	}
+	e.pos++
+	b := e.ternary()
+	if c != 0 {
+		return a
+	}
+	return b
+}
+
+func (e *exprParser) binary(min int) int64 {
+	x := e.unary()
+
+	for {
+		op := e.peek()
+		prec, ok := binaryPrec[op]
+		if !ok || prec < min || e.toks[e.pos].kind != tokPunct {
+			return x
+		}
+		e.pos++
+		y := e.binary(prec + 1)
+
+		switch op {
+		case "*":
+			x *= y
+		case "/", "%":
+			if y == 0 {
+				e.fail("division by zero")
+			}
+			if op == "/" {
+				x /= y
+			} else {
+				x %= y
+			}
+		case "+":
+			x += y
+		case "-":
+			x -= y
+		case "<<":
+			x <<= uint64(y)
+		case ">>":
+			x >>= uint64(y)
+		case "&":
+			x &= y
+		case "^":
+			x ^= y
+		case "|":
+			x |= y
+		default:
+			var b bool
+			switch op {
+			case "<":
+				b = x < y
+			case "<=":
+				b = x <= y
+			case ">":
+				b = x > y
+			case ">=":
+				b = x >= y
+			case "==":
+				b = x == y
+			case "!=":
+				b = x != y
+			case "&&":
+				b = x != 0 && y != 0
+			case "||":
+				b = x != 0 || y != 0
+			}
+			x = 0
+			if b {
+				x = 1
+			}
+		}
+	}
+}
+
+func (e *exprParser) unary() int64 {
+	if e.pos >= len(e.toks) {
+		e.fail("unexpected end of expression")
+	}
+	t := e.toks[e.pos]
+	e.pos++
+
+	switch t.kind {
+	case tokNumber:
+		v, err := parseInt(t.text)
+		if err != nil {
+			e.fail("%s", err)
+		}
+		return v
+	case tokChar:
+		v, _, _, err := strconv.UnquoteChar(t.text[1:len(t.text)-1], '\'')
+		if err != nil {
+			e.fail("bad character %s", t.text)
+		}
+		return int64(v)
+	case tokIdent:
+		if e.ident != nil {
+			if v, ok := e.ident(t.text); ok {
+				return v
+			}
+			e.fail("%s is not a constant", t.text)
+		}
+
+		// in #if other names are 0, and things like __has_include(<x.h>)
+		// false
+		if e.peek() == "(" {
+			depth := 0
+			for ; e.pos < len(e.toks); e.pos++ {
+				switch e.toks[e.pos].text {
+				case "(":
+					depth++
+				case ")":
+					depth--
+				}
+				if depth == 0 {
+					e.pos++
+					break
+				}
+			}
+			return 0
+		}
+		return 0
+	}
+
+	switch t.text {
+	case "(":
+		v := e.ternary()
+		if e.peek() != ")" {
+			e.fail("missing )")
+		}
+		e.pos++
+		return v
+	case "!":
+		if e.unary() == 0 {
+			return 1
+		}
+		return 0
+	case "-":
+		return -e.unary()
+	case "+":
+		return e.unary()
+	case "~":
+		return ^e.unary()
+	}
+
+	e.fail("unexpected %s", t.text)
+	return 0
+}
+
+// parseInt parses a C integer constant.
+func parseInt(s string) (int64, error) {
+	n := strings.TrimRight(s, "uUlL")
+	v, err := strconv.ParseInt(n, 0, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(n, 0, 64)
+		if uerr != nil {
+			return 0, fmt.Errorf("bad number %s", s)
+		}
+		v = int64(u)
+	}
+	return v, nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// typeNames returns the C names the header gives a struct or enum: kind
+// plus its tag, if it has one, then any typedefs of it. name is the one its
+// Go type is named after, the first typedef if there is one.
+func typeNames(h *Header, kind, tag string, is func(t *Type) bool) (names []string, name string) {
+	if tag != "" {
+		names = append(names, kind+" "+tag)
+		name = tag
+	}
+	for _, d := range h.Decls {
+		td, ok := d.(*Typedef)
+		if !ok || td.Type.Kind != Basic || td.Type.Const {
+			continue
+		}
+		if is(td.Type) || tag != "" && td.Type.Name == kind+" "+tag {
+			if len(names) == 0 || name == tag {
+				name = td.Name
+			}
+			names = append(names, td.Name)
+		}
+	}
+	return names, name
+}
+
+func structNames(h *Header, s *Struct) ([]string, string) {
+	return typeNames(h, "struct", s.Name, func(t *Type) bool { return t.Struct == s })
+}
+
+func enumNames(h *Header, e *Enum) ([]string, string) {
+	return typeNames(h, "enum", e.Name, func(t *Type) bool { return t.Enum == e })
+}
+
+// registerTypes adds the structs and enums h defines to types, so they are
+// passed as the Go types generateStruct and generateEnum write. Mappings
+// already there, from -types say, are kept.
+func registerTypes(h *Header) {
+	var ms []TypeMap
+	add := func(m TypeMap) {
+		if t, err := ParseType(m.C); err == nil {
+			if _, ok := types[t.String()]; !ok {
+				ms = append(ms, m)
+			}
+		}
+	}
+
+	for _, d := range h.Decls {
+		switch d := d.(type) {
+		case *Struct:
+			names, name := structNames(h, d)
+			if d.Union || len(names) == 0 {
+				continue
+			}
+			for _, n := range names {
+				add(TypeMap{
+					C:    n,
+					Go:   *sprefix + name,
+					In:   "{{.C}}, {{.C}}Free := {{.Go}}.toC()",
+					Free: "{{.C}}Free()",
+					Out: `func() (g {{.GoType}}) {
+	g.fromC(&{{.C}})
+	return
+}()`,
+				})
+
+				// pointers to const structs are only read, so they can be
+				// passed by value in Go
+				add(TypeMap{
+					C:    "const " + n + "*",
+					Go:   *sprefix + name,
+					In:   "{{.C}}, {{.C}}Free := {{.Go}}.toC()",
+					Arg:  "&{{.C}}",
+					Free: "{{.C}}Free()",
+					Out: `func() (g {{.GoType}}) {
+	if {{.C}} != nil {
+		g.fromC({{.C}})
+	}
+	return
+}()`,
+				})
+			}
+		case *Enum:
+			names, name := enumNames(h, d)
+			for _, n := range names {
+				add(TypeMap{C: n, Go: *sprefix + name})
+			}
+		}
+	}
+
+	if err := addTypes(ms); err != nil {
+		Fatalln(err)
+	}
+}
+
+// excluded reports whether -x leaves name out, saying so in the output.
+func excluded(name string) bool {
+	if *exclude != "" && regexp.MustCompile(*exclude).MatchString(name) {
+		Printf("//skipped %s in output\n\n", name)
+		return true
+	}
+	return false
+}
+
+// constValue is the Go constant for the C constant expression expr, if it is
+// one Go can spell: a number, a string or an integer expression.
+func constValue(expr string) (string, bool) {
+	toks, err := lex(expr, expr, 1)
+	if err != nil || len(toks) < 2 {
+		return "", false
+	}
+	toks = toks[:len(toks)-1]
+
+	// "adjacent" "strings" are joined
+	if toks[0].kind == tokString {
+		s := ""
+		for _, t := range toks {
+			if t.kind != tokString || t.text[0] != '"' {
+				return "", false
+			}
+			u, err := strconv.Unquote(t.text)
+			if err != nil {
+				return "", false
+			}
+			s += u
+		}
+		return strconv.Quote(s), true
+	}
+
+	if len(toks) == 1 {
+		switch t := toks[0]; t.kind {
+		case tokChar:
+			if _, _, _, err := strconv.UnquoteChar(t.text[1:], '\''); err == nil {
+				return t.text, true
+			}
+			return "", false
+		case tokNumber:
+			if n, ok := numberValue(t.text); ok {
+				return n, true
+			}
+		}
+	}
+
+	for _, t := range toks {
+		if t.kind != tokNumber && t.kind != tokPunct {
+			return "", false // casts, sizeof, other macros...
+		}
+	}
+	v, err := evalExpr(toks, func(string) (int64, bool) { return 0, false })
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatInt(v, 10), true
+}
+
+// numberValue is the C number n as Go writes it, without C's suffixes.
+func numberValue(n string) (string, bool) {
+	if _, err := parseInt(n); err == nil {
+		return strings.TrimRight(n, "uUlL"), true
+	}
+	if !prefix(n, "0x") && !prefix(n, "0X") {
+		n = strings.TrimRight(n, "fFlL")
+	}
+	if _, err := strconv.ParseFloat(n, 64); err == nil {
+		return n, true
+	}
+	return "", false
+}
+
+// generateDefines writes the object-like macros in h that are constants as
+// Go constants.
+func generateDefines(h *Header) {
+	var lines []string
+	for _, d := range h.Defines {
+		if prefix(d.Name, "_") {
+			continue // reserved, and include guards
+		}
+		v, ok := constValue(d.Expanded)
+		if !ok || excluded(d.Name) {
+			continue
+		}
+		for _, c := range d.Comment {
+			lines = append(lines, "\t"+c)
+		}
+		lines = append(lines, "\t"+*sprefix+d.Name+" = "+v)
+	}
+
+	if len(lines) > 0 {
+		Println("const (\n" + strings.Join(lines, "\n") + "\n)\n")
+	}
+}
+
+// enumValues are the values of the enumeration constants written so far,
+// for enums defined in terms of others.
+var enumValues = map[string]int64{}
+
+// generateEnum writes e as a Go type with a constant for each value, and a
+// String method. Anonymous enums that no typedef names are just constants.
+func generateEnum(h *Header, e *Enum) {
+	names, name := enumNames(h, e)
+	goName := *sprefix + name
+	typed := len(names) > 0
+	if typed && excluded(name) {
+		return
+	}
+
+	if typed {
+		Printf("// %s is %s.\n", goName, names[0])
+		if len(e.Comment) > 0 {
+			Println("//")
+		}
+	}
+	for _, c := range e.Comment {
+		Println(c)
+	}
+	if typed {
+		Printf("type %s int\n\n", goName)
+	}
+
+	type value struct {
+		name string
+		v    int64
+	}
+	var known []value
+	next, ok := int64(0), true
+
+	Println("const (")
+	for _, v := range e.Values {
+		val := ""
+		if v.Expr != "" {
+			ok = false
+			if toks, err := lex(v.Name, v.Expr, 1); err == nil {
+				lookup := func(n string) (int64, bool) { x, ok := enumValues[n]; return x, ok }
+				if next, err = evalExpr(toks[:len(toks)-1], lookup); err == nil {
+					ok = true
+					val = strconv.FormatInt(next, 10)
+					if len(toks) == 2 && toks[0].kind == tokNumber {
+						val, _ = numberValue(toks[0].text)
+					}
+				}
+			}
+		} else if ok {
+			val = strconv.FormatInt(next, 10)
+		}
+
+		if ok {
+			enumValues[v.Name] = next
+			known = append(known, value{v.Name, next})
+			next++
+		} else {
+			val = "C." + v.Name
+		}
+
+		for _, c := range v.Comment {
+			Println("\t" + c)
+		}
+		if typed {
+			Printf("\t%s%s %s = %s\n", *sprefix, v.Name, goName, val)
+		} else {
+			Printf("\t%s%s = %s\n", *sprefix, v.Name, val)
+		}
+	}
+	Print(")\n\n")
+
+	if !typed {
+		return
+	}
+
+	Printf("func (e %s) String() string {\n\tswitch e {\n", goName)
+	seen := map[int64]bool{}
+	for _, v := range known {
+		if !seen[v.v] {
+			seen[v.v] = true
+			Printf("\tcase %s%s:\n\t\treturn %q\n", *sprefix, v.name, v.name)
+		}
+	}
+	Printf("\t}\n\treturn fmt.Sprintf(\"%s(%%d)\", int(e))\n}\n\n", goName)
+}
+
+// fieldName is the exported Go name for the C field name, e.g. UserId for
+// user_id.
+func fieldName(name string) string {
+	n := ""
+	for _, s := range split(name, "_") {
+		n += strings.Title(s)
+	}
+	if n == "" || n[0] >= '0' && n[0] <= '9' {
+		n = "X" + n
+	}
+	return n
+}
+
+// field is how a struct field is converted.
+type field struct {
+	Field
+	Go, GoType string
+	toC, fromC string // code
+	free       bool
+	skipped    string // why it isn't converted, if it isn't
+}
+
+// structField works out how f is converted.
+func structField(f Field) (fd field, err error) {
+	fd.Field = f
+	if f.Name == "" {
+		return fd, fmt.Errorf("anonymous members are not supported")
+	}
+	if f.Bits != "" {
+		return fd, fmt.Errorf("cgo can't reach bit fields")
+	}
+
+	fd.Go = fieldName(f.Name)
+	s, c := "s."+fd.Go, "c."+f.Name
+	if goKeywords[f.Name] {
+		c = "c._" + f.Name // as cgo names it
+	}
+
+	if f.Type.Kind == Array {
+		n, ok := "", false
+		if toks, err := lex(f.Name, f.Type.Len, 1); err == nil && len(toks) > 1 {
+			var v int64
+			v, err = evalExpr(toks[:len(toks)-1], func(n string) (int64, bool) { x, ok := enumValues[n]; return x, ok })
+			n, ok = strconv.FormatInt(v, 10), err == nil
+		}
+		if !ok {
+			return fd, fmt.Errorf("can't tell the length of %s[%s]", f.Name, f.Type.Len)
+		}
+
+		elem := f.Type.Elem
+		switch e := resolveAll(elem); {
+		case e.Kind == Array:
+			return fd, fmt.Errorf("arrays of arrays are not supported")
+		case e.Kind == Basic && e.Name == "char":
+			// a string, NUL terminated if it fits
+			fd.GoType = "string"
+			fd.toC = fmt.Sprintf("for i := 0; i < len(%s) && i < len(%s)-1; i++ {\n\t%s[i] = %s(%s[i])\n}", s, c, c, cgoType(elem), s)
+			fd.fromC = fmt.Sprintf("%s = func() string {\n\tn := 0\n\tfor n < len(%s) && %s[n] != 0 {\n\t\tn++\n\t}\n\treturn C.GoStringN(&%s[0], C.int(n))\n}()", s, c, c, c)
+			return fd, nil
+		}
+
+		ec, err := lookupType(elem)
+		if err != nil {
+			return fd, err
+		}
+		if ec.arg("v") != "v" || ec.free("", "v") != "" {
+			return fd, fmt.Errorf("arrays of %s are not supported", elem)
+		}
+		fd.GoType = "[" + n + "]" + ec.Go
+		fd.toC = fmt.Sprintf("for i := range %s {\n%s\n\t%s[i] = v\n}", s, indent(ec.in(s+"[i]", "v")), c)
+		fd.fromC = fmt.Sprintf("for i := range %s {\n\t%s[i] = %s\n}", s, s, indent(ec.out(c + "[i]"))[1:])
+		return fd, nil
+	}
+
+	fc, err := lookupType(f.Type)
+	if err != nil {
+		return fd, err
+	}
+	cv := "c" + fd.Go
+	if fc.arg(cv) != cv {
+		// a field can't point into a Go variable
+		if resolveAll(f.Type).Kind != Pointer {
+			return fd, fmt.Errorf("%s is not supported in a struct", f.Type)
+		}
+		m := *passThrough
+		m.Go = cgoType(f.Type)
+		fc = conv{&m, m.Go}
+	}
+
+	fd.GoType = fc.Go
+	fd.toC = fc.in(s, cv)
+	if free := fc.free(s, cv); free != "" {
+		fd.free = true
+		fd.toC += "\nfrees = append(frees, func() {\n" + indent(free) + "\n})"
+	}
+	fd.toC += "\n" + c + " = " + cv
+	fd.fromC = s + " = " + fc.out(c)
+	return fd, nil
+}
+
+// generateStruct writes s as a Go struct, with methods converting it to and
+// from C.
+func generateStruct(h *Header, s *Struct) {
+	names, name := structNames(h, s)
+	if s.Union || len(names) == 0 || excluded(name) {
+		return
+	}
+	goName := *sprefix + name
+	ctype := cgoType(&Type{Name: names[0]})
+
+	var fields []field
+	free := false
+	for _, f := range s.Fields {
+		fd, err := structField(f)
+		if err != nil {
+			fd.skipped = err.Error()
+		}
+		free = free || fd.free
+		fields = append(fields, fd)
+	}
+
+	// Go names made the same by fieldName get told apart
+	used := map[string]bool{}
+	for i := range fields {
+		for fields[i].Go != "" && used[fields[i].Go] {
+			fields[i].Go += "_"
+		}
+		used[fields[i].Go] = true
+	}
+
+	Printf("// %s is %s.\n", goName, names[0])
+	if len(s.Comment) > 0 {
+		Println("//")
+	}
+	for _, c := range s.Comment {
+		Println(c)
+	}
+	Printf("type %s struct {\n", goName)
+	for _, fd := range fields {
+		for _, c := range fd.Comment {
+			Println("\t" + c)
+		}
+		if fd.skipped != "" {
+			Printf("\t//skipped field %s: %s\n", fd.Name, fd.skipped)
+			continue
+		}
+		Printf("\t%s %s\n", fd.Go, fd.GoType)
+	}
+	Print("}\n\n")
+
+	Printf("// toC converts s to C. free releases what that allocated, once C is done\n// with it.\n")
+	Printf("func (s *%s) toC() (c %s, free func()) {\n", goName, ctype)
+	if free {
+		Print("\tvar frees []func()\n\n")
+	}
+	for _, fd := range fields {
+		if fd.skipped == "" {
+			Print(indent(fd.toC), "\n\n")
+		}
+	}
+	if free {
+		Print("\treturn c, func() {\n\t\tfor _, f := range frees {\n\t\t\tf()\n\t\t}\n\t}\n}\n\n")
+	} else {
+		Print("\treturn c, func() {}\n}\n\n")
+	}
+
+	Printf("// fromC sets s from c.\nfunc (s *%s) fromC(c *%s) {\n", goName, ctype)
+	for _, fd := range fields {
+		if fd.skipped == "" {
+			Print(indent(fd.fromC), "\n")
+		}
+	}
+	Print("}\n\n")
+}
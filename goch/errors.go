@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// ErrorConv is how a C function reports failure. It is given for some
+// functions in the -errors file or in a comment on the function like
+//
+//	// goch:error fail=negative error=get_last_error
+//
+// The -errors file wins over the comments.
+type ErrorConv struct {
+	Func string `json:"func"` // the function, or a path.Match pattern of them; -errors only
+
+	// Fail is when a call failed: when its result is negative, null,
+	// nonzero or zero. errno, the default, takes any errno cgo sees as
+	// failure, and none says the function doesn't fail.
+	Fail string `json:"fail"`
+
+	// Error is a function in the header, taking nothing, that gives the
+	// error code or message once a call failed. errno by default.
+	Error string `json:"error"`
+}
+
+// failChecks are the conditions of each Fail on the C result.
+var failChecks = map[string]string{
+	"negative": "%s < 0",
+	"null":     "%s == nil",
+	"nonzero":  "%s != 0",
+	"zero":     "%s == 0",
+}
+
+// errorConvs are the conventions from the -errors file, in order.
+var errorConvs []ErrorConv
+
+// funcs are the functions in the header being wrapped, by name.
+var funcs = map[string]*Func{}
+
+// check says what is wrong with e, if anything.
+func (e ErrorConv) check() error {
+	if _, ok := failChecks[e.Fail]; !ok && e.Fail != "" && e.Fail != "errno" && e.Fail != "none" {
+		return fmt.Errorf("unknown fail %q", e.Fail)
+	}
+	if e.Error != "" && e.Error != "errno" && failChecks[e.Fail] == "" {
+		return fmt.Errorf("error=%s needs fail to be negative, null, nonzero or zero", e.Error)
+	}
+	return nil
+}
+
+// loadErrors reads a JSON array of ErrorConvs from the file name into
+// errorConvs, e.g.
+//
+//	[
+//		{"func": "real_open", "fail": "negative"},
+//		{"func": "real_*", "fail": "nonzero", "error": "real_last_error"}
+//	]
+func loadErrors(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var es []ErrorConv
+	if err = json.Unmarshal(b, &es); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	for _, e := range es {
+		if _, err := path.Match(e.Func, ""); err != nil {
+			return fmt.Errorf("%s: func %q: %s", name, e.Func, err)
+		}
+		if err := e.check(); err != nil {
+			return fmt.Errorf("%s: %s: %s", name, e.Func, err)
+		}
+	}
+	errorConvs = append(errorConvs, es...)
+
+	return nil
+}
+
+// errorComment reports whether the comment line c is a goch:error one.
+func errorComment(c string) bool {
+	return prefix(trim(strings.TrimLeft(trim(c), "/*")), "goch:error")
+}
+
+// errorConv finds how f reports failure: the first -errors entry matching
+// it, else its goch:error comment, else errno.
+func errorConv(f *Func) (ErrorConv, error) {
+	for _, e := range errorConvs {
+		if ok, _ := path.Match(e.Func, f.Name); ok {
+			return e, nil
+		}
+	}
+
+	e := ErrorConv{Func: f.Name}
+	for _, c := range f.Comment {
+		if !errorComment(c) {
+			continue
+		}
+		c = trim(strings.TrimLeft(trim(c), "/*"))
+		for _, kv := range strings.Fields(c[len("goch:error"):]) {
+			i := strings.Index(kv, "=")
+			switch {
+			case i > 0 && kv[:i] == "fail":
+				e.Fail = kv[i+1:]
+			case i > 0 && kv[:i] == "error":
+				e.Error = kv[i+1:]
+			default:
+				return e, fmt.Errorf("bad goch:error %q", kv)
+			}
+		}
+	}
+	return e, e.check()
+}
+
+// failure is the code returning the error for a call of f that failed, whose
+// C result is v and errno err. ret converts the result.
+func (e ErrorConv) failure(f *Func, ret conv) (string, error) {
+	fields := []string{fmt.Sprintf("Func: %q", f.Name)}
+	code := "" // the result, when it is the error code
+	if e.Fail != "null" && ret.Go != "bool" {
+		code = "Code: int(v)"
+	}
+
+	if e.Error == "" || e.Error == "errno" {
+		if code != "" {
+			fields = append(fields, code)
+		}
+		fields = append(fields, "Err: err")
+	} else {
+		name := strings.TrimSuffix(e.Error, "()")
+		ef, ok := funcs[name]
+		if !ok || len(ef.Params) > 0 || ef.Variadic {
+			return "", fmt.Errorf("error function %s() isn't in the header", name)
+		}
+		c, err := lookupType(ef.Result)
+		if err != nil {
+			return "", fmt.Errorf("error function %s: %s", name, err)
+		}
+
+		out := c.out("C." + name + "()")
+		switch {
+		case c.Go == "string":
+			if code != "" {
+				fields = append(fields, code)
+			}
+			fields = append(fields, "Msg: "+out)
+		case c.Go != "" && c.Go != "bool" && resolveAll(ef.Result).Kind == Basic:
+			if c.Go != "int" {
+				out = "int(" + out + ")"
+			}
+			fields = append(fields, "Code: "+out)
+		default:
+			return "", fmt.Errorf("error function %s doesn't give a code or message", name)
+		}
+	}
+
+	return fmt.Sprintf("&%sError{%s}", *sprefix, strings.Join(fields, ", ")), nil
+}
+
+// generateErrorType writes the error type wrappers return when a call fails
+// by its error convention.
+func generateErrorType() {
+	Printf(`// %[1]sError is a failure reported by a C function.
+type %[1]sError struct {
+	Func string // the C function
+	Code int    // the error code, if it gave one
+	Msg  string // the error message, if it gave one
+	Err  error  // errno, if it was set
+}
+
+func (e *%[1]sError) Error() string {
+	switch {
+	case e.Msg != "":
+		return e.Func + ": " + e.Msg
+	case e.Err != nil:
+		return e.Func + ": " + e.Err.Error()
+	case e.Code != 0:
+		return fmt.Sprintf("%%s failed with %%d", e.Func, e.Code)
+	}
+	return e.Func + " failed"
+}
+
+func (e *%[1]sError) Unwrap() error { return e.Err }
+
+`, *sprefix)
+}
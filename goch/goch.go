@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -8,7 +9,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -17,11 +18,15 @@ const version string = "0.0.5 Wed May 27 14:40:45 2015 -0400 linux/amd64"
 var (
 	outputfile    *string = flag.String("o", "", "write result to this output file")
 	overwrite     *bool   = flag.Bool("w", false, "overwrite output file if it exists")
-	exclude       *string = flag.String("x", "", "exclude functions matching this regex")
+	exclude       *string = flag.String("x", "", "exclude functions, types and constants matching this regex")
 	showversion   *bool   = flag.Bool("version", false, "display version and exit")
 	packageover   *string = flag.String("P", "", "override the output package name")
 	discarderrors *bool   = flag.Bool("noerr", false, "discard returned error values from C")
 	sprefix       *string = flag.String("p", "C", "prepend this string to generated function names")
+	defines       *string = flag.String("D", "", "comma separated macros to take as defined in #if, as NAME or NAME=VALUE")
+	typesfile     *string = flag.String("types", "", "JSON file of C to Go type mappings, adding to or overriding the built in ones")
+	errorsfile    *string = flag.String("errors", "", "JSON file of how functions report failure, overriding goch:error comments")
+	bufsize       *int    = flag.Int("bufsize", 1024, "size of the buffers made for C functions to write strings to")
 )
 
 func init() {
@@ -30,10 +35,54 @@ func init() {
 		msg := `Each function in the input will generate a matching Go function that calls the
 C function and returns it's return value managing memory appropriately.
 
+The header is parsed as C: #if blocks are followed and macros expanded, but
+#include is not, so macros defined in other headers that matter to the
+declarations (an export macro, say) may need to be given with -D.
+
 ` + prog + ` will also copy comments from the header file into the generated file if
-they are "attached" to a function definition (ie. there must be no spaces between the
+they are "attached" to a function definition (ie. there must be no blank lines between the
 comment block and the function signature).
 
+C types are converted to Go by a built in table covering C's basic types, stdint.h,
+size_t, strings (char*), string arrays (char**) and void* (unsafe.Pointer); other
+pointers are passed as cgo pointers. More can be given with -types, a JSON array of
+
+	{"c": "time_t", "go": "int64", "in": "...", "arg": "...", "free": "...", "out": "..."}
+
+where in, arg, free and out are optional text/template code: in converts the Go
+value {{.Go}} to the C variable {{.C}} before the call, arg is what is passed to
+C, free releases anything in allocated and out converts a C result {{.C}} to Go.
+{{.GoType}} and {{.CType}} are the Go and cgo types.
+
+Structs in the header become Go structs, with toC and fromC methods converting
+them field by field, and are passed by value (as are pointers to const ones).
+Enums become Go types with a constant for each value and a String method, and
+#defines of numbers and strings become Go constants.
+
+Wrappers return the errno cgo sees as their error, unless told how the function
+reports failure by a comment on it or by -errors, a JSON array of
+
+	{"func": "real_*", "fail": "negative", "error": "real_last_error"}
+
+where func is a function name or pattern, fail is when a call failed (its result
+is negative, null, nonzero or zero, or none for functions that can't fail) and
+error is a function in the header giving the error code or message, errno by
+default. The comment is the same, as
+
+	// goch:error fail=negative error=real_last_error
+
+Calls that fail then return a *CError (named after -p) holding the code, message
+or errno.
+
+Out-parameters and string buffers are returned as results after the function's
+own. A non-const char* followed by its size (named like len, size or n) is taken
+as a buffer, made -bufsize big, and a non-const pointer named like out, out_x,
+xOut or ret as an out-parameter. Comments on the function can say otherwise:
+
+	// goch:buf buf len 256
+	// goch:out count
+	// goch:in values
+
 By default, ` + prog + ` prepends the letter C to all generated functions (ie. a function
 called MyFunc will generate a wrapper called CMyFunc). Use the -p flag to override this.`
 
@@ -50,68 +99,49 @@ var (
 )
 
 type Param struct {
-	Type  string
+	Type  *Type
 	Name  string
 	CName string
 }
 
-func (p Param) String() string {
-	return fmt.Sprintf("%s %s", p.Name, ctypeToGoType(p.Type))
+var goKeywords = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true, "continue": true,
+	"default": true, "defer": true, "else": true, "fallthrough": true, "for": true,
+	"func": true, "go": true, "goto": true, "if": true, "import": true,
+	"interface": true, "map": true, "package": true, "range": true, "return": true,
+	"select": true, "struct": true, "switch": true, "type": true, "var": true,
 }
 
-func strings2params(params []string) (ps []Param) {
-	for _, param := range params {
-		var ftype, fname string
-
-		pparts := split(param, " ")
-
-		if len(pparts) != 2 {
-			Fatalf("syntax error: \"%s\" is not a valid parameter specification", param)
-		}
-
-		ftype = pparts[0]
-		fname = pparts[1]
-
-		if prefix(fname, "*") {
-			ftype += "*"
-			fname = fname[1:]
-		}
-
-		if strings.HasSuffix(fname, "[]") {
-			ftype += "*"
-			fname = fname[:len(fname)-2]
+// goParams names the parameters of f for the Go wrapper.
+func goParams(f *Func) (ps []Param) {
+	for i, p := range f.Params {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("p%d", i)
 		}
-
-		if strings.Contains(fname, "[]") {
-			Fatalf("syntax error: \"%s\" is not a valid parameter specification", param)
+		if goKeywords[p.Name] {
+			p.Name += "_"
 		}
-
-		ps = append(ps, Param{ftype, fname, "c" + strings.Title(fname)})
+		p.CName = "c" + strings.Title(p.Name)
+		ps = append(ps, p)
 	}
 
 	return ps
 }
 
-func ctypeToGoType(ctype string) string {
-	switch ctype {
-	case "char*":
-		return "string"
-	case "char**":
-		return "[]string"
-	case "int":
-		return "int"
-	case "short":
-		return "bool"
-	case "float":
-		return "float32"
-	case "void":
-		return ""
-	default:
-		Fatalln("unknown C type", ctype)
+// parseDefines parses the -D flag.
+func parseDefines(s string) map[string]string {
+	m := map[string]string{}
+	for _, d := range split(s, ",") {
+		if d = trim(d); d == "" {
+			continue
+		}
+		if i := strings.Index(d, "="); i >= 0 {
+			m[d[:i]] = d[i+1:]
+		} else {
+			m[d] = "1"
+		}
 	}
-
-	panic("should not have reached here!")
-	return ""
+	return m
 }
 
 var w io.Writer
@@ -125,19 +155,83 @@ func Fatalln(a ...interface{})               { Fatal(fmt.Sprintln(a...)) }
 func Fatalf(format string, a ...interface{}) { Fatal(fmt.Sprintf(format, a...)) }
 
 func generate(src string) {
-	f, _ := os.Open(src)
-	b, _ := ioutil.ReadAll(f)
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		Fatalln(err)
+	}
 	s, _ := filepath.Abs(src)
 
+	h, err := ParseHeader(src, b, parseDefines(*defines))
+	if err != nil {
+		Fatalln(err)
+	}
+
+	typedefs = map[string]*Type{}
+	funcs = map[string]*Func{}
+	for _, d := range h.Decls {
+		switch d := d.(type) {
+		case *Typedef:
+			typedefs[d.Name] = d.Type
+		case *Func:
+			funcs[d.Name] = d
+		}
+	}
+
 	if *packageover == "" {
 		*packageover = filepath.Base(filepath.Dir(s))
 	}
 
+	registerTypes(h)
+
+	// the declarations go first, to see what they need imported
+	out := w
+	var body bytes.Buffer
+	w = &body
+
+	generateDefines(h)
+
+	for _, d := range h.Decls {
+		if e, ok := d.(*Enum); ok {
+			generateEnum(h, e)
+		}
+	}
+
+	for _, d := range h.Decls {
+		if s, ok := d.(*Struct); ok {
+			generateStruct(h, s)
+		}
+	}
+
+	seen := map[string]bool{}
+	needErrorType = false
+
+	for _, d := range h.Decls {
+		f, ok := d.(*Func)
+		if !ok || seen[f.Name] {
+			continue
+		}
+		seen[f.Name] = true
+
+		if excluded(f.Name) {
+			continue
+		}
+
+		if err := generateFunc(f); err != nil {
+			Printf("//skipped %s in output: %s\n\n", f.Name, err)
+		}
+	}
+
+	if needErrorType {
+		generateErrorType()
+	}
+
+	w = out
+
 	Println("package", *packageover)
-	Println("\n// Auto-generated Go wrapper for", src, "\n// DO NOT EDIT THIS FILE BY HAND\n")
+	Printf("\n// Auto-generated Go wrapper for %s\n// DO NOT EDIT THIS FILE BY HAND\n\n", src)
 
 	if *discarderrors {
-		Println("// WARNING: C error return logic disabled\n")
+		Print("// WARNING: C error return logic disabled\n\n")
 	}
 
 	Printf("//#include \"%s\"\n", src)
@@ -146,148 +240,230 @@ func generate(src string) {
 		Printf("//#include <stdlib.h>\n")
 	}
 
-	Println("import \"C\"\n")
-	Println("import \"unsafe\"\n")
+	Print("import \"C\"\n\n")
 
-	lastComment := ""
+	if bytes.Contains(body.Bytes(), []byte("fmt.")) {
+		Print("import \"fmt\"\n\n")
+	}
 
-	for _, line := range split(string(b), "\n") {
-		line = strings.TrimSpace(line)
+	if bytes.Contains(body.Bytes(), []byte("unsafe.")) {
+		Print("import \"unsafe\"\n\n")
+	}
 
-		switch {
-		case line == "":
-			lastComment = ""
-			continue
-		case prefix(line, "#"):
-			continue
-		case prefix(line, "//"):
-			lastComment = line
-		default:
-			line = trim(replace(line, "extern", "", -1))
+	body.WriteTo(w)
+}
 
-			returnType := split(line, " ")[0]
-			funcName := trim(split(split(line, "(")[0], " ")[1])
-			params := split(split(split(line, "(")[1], ")")[0], ",")
+// indent indents each line of code by a tab.
+func indent(code string) string {
+	return "\t" + strings.Replace(code, "\n", "\n\t", -1)
+}
 
-			if *exclude != "" && regexp.MustCompile(*exclude).MatchString(funcName) {
-				Printf("//skipped %s in output\n\n", funcName)
-				continue
-			}
+// deferred is code deferring code.
+func deferred(code string) string {
+	if !strings.Contains(code, "\n") && strings.HasSuffix(code, ")") {
+		return "defer " + code
+	}
+	return "defer func() {\n" + indent(code) + "\n}()"
+}
 
-			if funcName[0] == '*' {
-				returnType += "*"
-				funcName = funcName[1:]
-			}
+// needErrorType is set once a wrapper returns the error type.
+var needErrorType bool
+
+// generateFunc writes the Go wrapper for f, or says why it can't.
+func generateFunc(f *Func) error {
+	if f.Variadic {
+		return fmt.Errorf("cgo can't call variadic functions")
+	}
 
-			goReturnType := ctypeToGoType(returnType)
+	funcName := f.Name
+	ret, err := lookupType(f.Result)
+	if err != nil {
+		return err
+	}
+	void := ret.Go == ""
 
-			parg := []string{}
-			for i, p := range params {
-				params[i] = trim(p)
-				if params[i] != "" {
-					parg = append(parg, params[i])
-				}
-			}
+	plist := goParams(f)
+	kinds, sizes, err := paramKinds(f)
+	if err != nil {
+		return err
+	}
+	convs := make([]conv, len(plist))
+	for i, p := range plist {
+		switch kinds[i] {
+		case inParam, lenParam:
+			convs[i], err = lookupType(p.Type)
+		case outParam:
+			convs[i], err = outConv(p.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", p.Name, err)
+		}
+	}
 
-			plist := strings2params(parg)
+	ec, err := errorConv(f)
+	if err != nil {
+		return err
+	}
+	noerr := *discarderrors || ec.Fail == "none"
 
-			if lastComment != "" {
-				Println(lastComment)
-				lastComment = ""
+	// the check on the result, if it says when the call failed
+	check, failure := "", ""
+	if c, ok := failChecks[ec.Fail]; ok && !noerr {
+		if void {
+			return fmt.Errorf("fail=%s needs a result", ec.Fail)
+		}
+		r := resolveAll(f.Result)
+		switch {
+		case ec.Fail == "null" && r.Kind != Pointer:
+			return fmt.Errorf("fail=null needs a pointer result, not %s", f.Result)
+		case ec.Fail != "null" && r.Kind == Pointer:
+			return fmt.Errorf("fail=%s needs a number result, not %s", ec.Fail, f.Result)
+		case r.Kind == Basic && (r.Name == "_Bool" || r.Name == "bool"):
+			check = map[string]string{"nonzero": "v", "zero": "!v"}[ec.Fail]
+			if check == "" {
+				return fmt.Errorf("fail=%s needs a number result, not %s", ec.Fail, f.Result)
 			}
+		default:
+			check = fmt.Sprintf(c, "v")
+		}
+		if failure, err = ec.failure(f, ret); err != nil {
+			return err
+		}
+		needErrorType = true
+	}
+	errno := !noerr && (check == "" || ec.Error == "" || ec.Error == "errno")
 
-			Printf("func %s%s(", *sprefix, funcName)
+	// the results: what C returns, then the out-parameters and buffers
+	var rtypes, results []string
+	if !void {
+		rtypes = append(rtypes, ret.Go)
+		results = append(results, ret.out("v"))
+	}
+	for i, p := range plist {
+		switch kinds[i] {
+		case outParam:
+			rtypes = append(rtypes, convs[i].Go)
+			results = append(results, convs[i].out(p.CName))
+		case bufParam:
+			rtypes = append(rtypes, "string")
+			if ctype := cgoType(p.Type); ctype != "*C.char" {
+				results = append(results, "C.GoString((*C.char)(unsafe.Pointer("+p.CName+")))")
+			} else {
+				results = append(results, "C.GoString("+p.CName+")")
+			}
+		}
+	}
 
-			pstrings := []string{}
+	for _, c := range f.Comment {
+		if !isAnnotation(c) {
+			Println(c)
+		}
+	}
 
-			for _, p := range plist {
-				pstrings = append(pstrings, p.String())
-			}
+	Printf("func %s%s(", *sprefix, funcName)
 
-			Print(strings.Join(pstrings, ", "))
+	pstrings := []string{}
 
-			Print(") ")
+	for i, p := range plist {
+		if kinds[i] == inParam {
+			pstrings = append(pstrings, p.Name+" "+convs[i].Go)
+		}
+	}
 
-			if returnType != "void" {
-				Print("(", goReturnType)
-				if !*discarderrors {
-					Print(", error")
-				}
-				Print(")")
-			} else {
-				if !*discarderrors {
-					Print("error")
-				}
-			}
+	Print(strings.Join(pstrings, ", "))
 
-			Print(" {\n")
-
-			for _, p := range plist {
-				switch p.Type {
-				case "char*":
-					Print("\t", p.CName, " := C.CString(", p.Name, ")\n")
-					Print("\tdefer C.free(unsafe.Pointer(", p.CName, "))\n")
-				case "short":
-					Print("\t", p.CName, " := C.short(0)\n")
-					Print("\tif ", p.Name, " {\n\t\t", p.CName, " = C.short(1)\n\t}\n")
-				case "int":
-					Print("\t", p.CName, " := C.int(", p.Name, ")\n")
-				case "float":
-					Print("\t", p.CName, " := C.float(", p.Name, ")\n")
-				case "char**":
-					Print("\t", p.CName, " := []*C.char{}\n")
-					Print("\tfor _, val := range ", p.Name, " {\n\t\tcval := C.CString(val)\n\t\tdefer C.free(unsafe.Pointer(cval))\n\t\t", p.CName, " = append(", p.CName, ", cval)\n\t}\n")
-				}
-
-				Println()
-			}
+	Print(") ")
 
-			estring := ", err"
+	if len(rtypes) > 0 {
+		if !noerr {
+			rtypes = append(rtypes, "error")
+		}
+		Print("(", strings.Join(rtypes, ", "), ")")
+	} else {
+		if !noerr {
+			Print("error")
+		}
+	}
 
-			if *discarderrors {
-				estring = ""
-			}
+	Print(" {\n")
 
-			if returnType != "void" {
-				Print("\tv", estring, " := C.", funcName, "(")
-			} else if !*discarderrors {
-				Print("\t_", estring, " := C.", funcName, "(")
-			} else {
-				Print("\tC.", funcName, "(")
+	for i, p := range plist {
+		switch kinds[i] {
+		case inParam:
+			Print(indent(convs[i].in(p.Name, p.CName)), "\n")
+			if free := convs[i].free(p.Name, p.CName); free != "" {
+				Print(indent(deferred(free)), "\n")
 			}
+		case outParam:
+			Printf("\tvar %s %s\n", p.CName, cgoType(resolve(p.Type).Elem))
+		case bufParam:
+			// one more than C is told, so there's always a NUL
+			Printf("\t%s := (%s)(C.calloc(%d, 1))\n", p.CName, cgoType(p.Type), sizes[i]+1)
+			Print(indent(deferred("C.free(unsafe.Pointer("+p.CName+"))")), "\n")
+		case lenParam:
+			Print(indent(convs[i].in(strconv.Itoa(sizes[i-1]), p.CName)), "\n")
+		}
+		Println()
+	}
 
-			cargs := []string{}
+	estring := ", err"
 
-			for _, p := range plist {
-				if p.Type == "char**" {
-					cargs = append(cargs, "&"+p.CName+"[0]")
-				} else {
-					cargs = append(cargs, p.CName)
-				}
-			}
+	if !errno {
+		estring = ""
+	}
 
-			Print(strings.Join(cargs, ", "))
-
-			Print(")")
-
-			switch returnType {
-			case "void":
-				if !*discarderrors {
-					Print("\n\n\treturn err")
-				}
-			case "char*":
-				Print("\n\n\ttmp := C.GoString(v)\t// copy the string so ownership doesn't get confused\n\treturn (v + \" \")[:len(v)]", estring)
-			case "short":
-				Print("\n\n\treturn v > 0", estring)
-			default:
-				Print("\n\n\treturn "+goReturnType+"(v)", estring)
-			}
+	if !void {
+		Print("\tv", estring, " := C.", funcName, "(")
+	} else if errno {
+		Print("\t_", estring, " := C.", funcName, "(")
+	} else {
+		Print("\tC.", funcName, "(")
+	}
 
-			Println("\n}\n")
+	cargs := []string{}
 
-			// fmt.Println(returnType, funcName, plist)
+	for i, p := range plist {
+		switch kinds[i] {
+		case outParam:
+			cargs = append(cargs, "&"+p.CName)
+		case bufParam:
+			cargs = append(cargs, p.CName)
+		default:
+			cargs = append(cargs, convs[i].arg(p.CName))
 		}
 	}
+
+	Print(strings.Join(cargs, ", "))
+
+	Print(")")
+
+	// returned is the results, for a return n tabs in
+	returned := func(n int) string {
+		var rs []string
+		for _, r := range results {
+			for i := 0; i < n; i++ {
+				r = indent(r)
+			}
+			rs = append(rs, r[n:])
+		}
+		return strings.Join(rs, ", ")
+	}
+
+	switch {
+	case len(results) == 0:
+		if errno {
+			Print("\n\n\treturn err")
+		}
+	case check != "":
+		Printf("\n\tif %s {\n\t\treturn %s, %s\n\t}", check, returned(2), failure)
+		Print("\n\n\treturn ", returned(1), ", nil")
+	default:
+		Print("\n\n\treturn ", returned(1), estring)
+	}
+
+	Print("\n}\n\n")
+
+	return nil
 }
 
 func main() {
@@ -298,6 +474,18 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *typesfile != "" {
+		if err := loadTypes(*typesfile); err != nil {
+			Fatalln(err)
+		}
+	}
+
+	if *errorsfile != "" {
+		if err := loadErrors(*errorsfile); err != nil {
+			Fatalln(err)
+		}
+	}
+
 	if flag.NArg() == 0 {
 		flag.Usage()
 		os.Exit(1)
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// paramKind is how a wrapper passes a parameter to C.
+type paramKind int
+
+const (
+	inParam  paramKind = iota // from a Go argument
+	outParam                  // a pointer to a C variable, which is returned
+	bufParam                  // a buffer C writes a string to, which is returned
+	lenParam                  // the size of the buffer before it
+)
+
+// outNames are parameter names taken to be out-parameters, e.g. out,
+// out_len, ret or nameOut.
+var outNames = regexp.MustCompile(`^(out|Out|ret|result|res)(_|[A-Z0-9]|$)|_out$|Out$`)
+
+// lenNames are parameter names taken to be the size of the buffer before
+// them, e.g. len, bufsize or n.
+var lenNames = regexp.MustCompile(`(?i)len|size|cap|max|^n$`)
+
+// annotations are the goch:in, goch:out and goch:buf comments on f, by
+// parameter name:
+//
+//	// goch:out count name
+//	// goch:buf buf len 256
+//	// goch:in values
+//
+// goch:out and goch:in say parameters are or aren't out-parameters, and
+// goch:buf that a char* is a buffer for a string, with its size after it
+// and, optionally, how big it should be.
+func annotations(f *Func) (kinds map[string]paramKind, sizes map[string]int, err error) {
+	kinds, sizes = map[string]paramKind{}, map[string]int{}
+	for _, c := range f.Comment {
+		words := strings.Fields(trim(strings.TrimLeft(trim(c), "/*")))
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "goch:in":
+			for _, n := range words[1:] {
+				kinds[n] = inParam
+			}
+		case "goch:out":
+			for _, n := range words[1:] {
+				kinds[n] = outParam
+			}
+		case "goch:buf":
+			if len(words) < 3 || len(words) > 4 {
+				return nil, nil, fmt.Errorf("goch:buf needs a buffer, its size and optionally how big it is")
+			}
+			kinds[words[1]], kinds[words[2]] = bufParam, lenParam
+			if len(words) == 4 {
+				n, err := strconv.Atoi(words[3])
+				if err != nil || n <= 0 {
+					return nil, nil, fmt.Errorf("bad goch:buf size %s", words[3])
+				}
+				sizes[words[1]] = n
+			}
+		}
+	}
+	return kinds, sizes, nil
+}
+
+// isAnnotation reports whether the comment line c is a goch: one, which
+// wrappers leave out of their comments.
+func isAnnotation(c string) bool {
+	return prefix(trim(strings.TrimLeft(trim(c), "/*")), "goch:")
+}
+
+// isChar reports whether t is char, as a string buffer is made of.
+func isChar(t *Type) bool {
+	t = resolve(t)
+	return t.Kind == Basic && t.Name == "char"
+}
+
+// isInteger reports whether t is an integer type, as sizes are.
+func isInteger(t *Type) bool {
+	t = resolve(t)
+	if t.Kind != Basic || t.Name == "char" || t.Name == "_Bool" || t.Name == "bool" {
+		return false
+	}
+	m, ok := known(t)
+	return ok && (prefix(m.Go, "int") || prefix(m.Go, "uint"))
+}
+
+// paramKinds works out how each parameter of f is passed: as annotated, or
+// else a non-const char* followed by a size looks like a buffer and a
+// pointer named like out an out-parameter. sizes are how big each buffer
+// is.
+func paramKinds(f *Func) (kinds []paramKind, sizes []int, err error) {
+	named, bufSizes, err := annotations(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	for n := range named {
+		found := false
+		for _, p := range f.Params {
+			found = found || p.Name == n
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("annotated parameter %s isn't there", n)
+		}
+	}
+
+	kinds, sizes = make([]paramKind, len(f.Params)), make([]int, len(f.Params))
+	for i := 0; i < len(f.Params); i++ {
+		p := f.Params[i]
+		k, ok := named[p.Name]
+		t := resolve(p.Type)
+
+		switch {
+		case ok && k == bufParam:
+			if t.Kind != Pointer || t.Elem.Const || !isChar(t.Elem) {
+				return nil, nil, fmt.Errorf("buffer %s isn't a char*", p.Name)
+			}
+			if i+1 == len(f.Params) || named[f.Params[i+1].Name] != lenParam || !isInteger(f.Params[i+1].Type) {
+				return nil, nil, fmt.Errorf("buffer %s isn't followed by its size", p.Name)
+			}
+		case ok && k == lenParam:
+			if i == 0 || kinds[i-1] != bufParam {
+				return nil, nil, fmt.Errorf("size %s doesn't follow its buffer", p.Name)
+			}
+		case ok:
+		case t.Kind == Pointer && !t.Elem.Const && isChar(t.Elem) &&
+			i+1 < len(f.Params) && isInteger(f.Params[i+1].Type) &&
+			lenNames.MatchString(f.Params[i+1].Name) && !hasKind(named, f.Params[i+1].Name):
+			k = bufParam
+		case i > 0 && kinds[i-1] == bufParam:
+			k = lenParam
+		case t.Kind == Pointer && !t.Elem.Const && outNames.MatchString(p.Name):
+			k = outParam
+		}
+
+		if k == bufParam {
+			sizes[i] = *bufsize
+			if n, ok := bufSizes[p.Name]; ok {
+				sizes[i] = n
+			}
+		}
+		kinds[i] = k
+	}
+
+	return kinds, sizes, nil
+}
+
+// hasKind reports whether name was annotated.
+func hasKind(named map[string]paramKind, name string) bool {
+	_, ok := named[name]
+	return ok
+}
+
+// outConv finds how the out-parameter of type t, a pointer, is returned.
+func outConv(t *Type) (conv, error) {
+	u := resolve(t)
+	if u.Kind != Pointer {
+		return conv{}, fmt.Errorf("out-parameter isn't a pointer")
+	}
+	c, err := lookupType(u.Elem)
+	if err != nil {
+		return conv{}, err
+	}
+	if c.Go == "" {
+		return conv{}, fmt.Errorf("out-parameter points to void")
+	}
+	if c.arg("v") != "v" {
+		return conv{}, fmt.Errorf("%s can't be returned through an out-parameter", u.Elem)
+	}
+	return c, nil
+}
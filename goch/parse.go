@@ -0,0 +1,823 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Header is a parsed C header.
+type Header struct {
+	Name    string
+	Decls   []Decl // in the order they appear
+	Defines []*Define
+}
+
+// Define is an object-like macro defined by the header.
+type Define struct {
+	Name     string
+	Value    string // as written
+	Expanded string // with the macros in it expanded
+	Comment  []string
+	Line     int
+}
+
+// Decl is a top level declaration: a *Func, *Var, *Typedef, *Struct or *Enum.
+type Decl interface {
+	decl()
+}
+
+// Func is a function declaration, or definition if Body is set.
+type Func struct {
+	Name     string
+	Result   *Type
+	Params   []Param
+	Variadic bool
+	Static   bool
+	Inline   bool
+	Body     bool
+	Comment  []string
+	Line     int
+}
+
+// Var is a variable declaration.
+type Var struct {
+	Name    string
+	Type    *Type
+	Extern  bool
+	Static  bool
+	Comment []string
+	Line    int
+}
+
+// Typedef gives Type another name.
+type Typedef struct {
+	Name    string
+	Type    *Type
+	Comment []string
+	Line    int
+}
+
+// Struct is a struct or union definition. Name is the tag, empty for an
+// anonymous one.
+type Struct struct {
+	Name    string
+	Union   bool
+	Fields  []Field
+	Comment []string
+	Line    int
+}
+
+// Field is a member of a struct or union. Name is empty for an anonymous
+// struct or union member.
+type Field struct {
+	Name    string
+	Type    *Type
+	Bits    string // bit field width, if any
+	Comment []string
+}
+
+// Enum is an enum definition. Name is the tag, empty for an anonymous one.
+type Enum struct {
+	Name    string
+	Values  []EnumValue
+	Comment []string
+	Line    int
+}
+
+// EnumValue is an enumeration constant. Expr is the value as written, empty
+// if it is one more than the last.
+type EnumValue struct {
+	Name    string
+	Expr    string
+	Comment []string
+}
+
+func (*Func) decl()    {}
+func (*Var) decl()     {}
+func (*Typedef) decl() {}
+func (*Struct) decl()  {}
+func (*Enum) decl()    {}
+
+// TypeKind says what sort of type a Type is.
+type TypeKind int
+
+const (
+	Basic TypeKind = iota // int, unsigned long, struct foo, size_t...
+	Pointer
+	Array
+	Function
+)
+
+// Type is a C type.
+type Type struct {
+	Kind  TypeKind
+	Name  string // Basic: e.g. "unsigned int", "struct foo" or a typedef name
+	Const bool
+
+	Elem *Type  // Pointer and Array: what is pointed to; Function: the result
+	Len  string // Array: the length as written, empty if unsized
+
+	Params   []Param // Function
+	Variadic bool
+
+	Struct *Struct // Basic: the struct or union defined along with the type
+	Enum   *Enum   // Basic: the enum defined along with the type
+}
+
+// String spells t as C would, as in a cast.
+func (t *Type) String() string {
+	return t.spell("", true)
+}
+
+// bare spells t without qualifiers, e.g. "char*" for const char *. It is
+// the name types are looked up by.
+func (t *Type) bare() string {
+	return t.spell("", false)
+}
+
+// spell spells t around the declarator d.
+func (t *Type) spell(d string, qualified bool) string {
+	switch t.Kind {
+	case Pointer:
+		d = "*" + d
+		if qualified && t.Const {
+			d = "* const " + d[1:]
+		}
+		if t.Elem.Kind == Array || t.Elem.Kind == Function {
+			d = "(" + d + ")"
+		}
+		return t.Elem.spell(d, qualified)
+	case Array:
+		return t.Elem.spell(d+"["+t.Len+"]", qualified)
+	case Function:
+		var ps []string
+		for _, p := range t.Params {
+			ps = append(ps, p.Type.spell("", qualified))
+		}
+		if t.Variadic {
+			ps = append(ps, "...")
+		}
+		if len(ps) == 0 {
+			ps = []string{"void"}
+		}
+		return t.Elem.spell(d+"("+strings.Join(ps, ", ")+")", qualified)
+	}
+
+	s := t.Name
+	if qualified && t.Const {
+		s = "const " + s
+	}
+	if d != "" && d[0] != '*' && d[0] != '(' && d[0] != '[' {
+		s += " "
+	}
+	return s + d
+}
+
+// uses reports whether t involves a type of kind k.
+func (t *Type) uses(k TypeKind) bool {
+	if t == nil {
+		return false
+	}
+	if t.Kind == k {
+		return true
+	}
+	for _, p := range t.Params {
+		if p.Type.uses(k) {
+			return true
+		}
+	}
+	return t.Elem.uses(k)
+}
+
+// ParseHeader parses the C header src. defines are the macros to take as
+// defined, by name. Declarations that can't be made sense of are skipped with
+// a warning.
+func ParseHeader(name string, src []byte, defines map[string]string) (*Header, error) {
+	toks, err := lex(name, string(src), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	pp, err := newPreprocessor(name, defines)
+	if err != nil {
+		return nil, err
+	}
+	if toks, err = pp.process(toks); err != nil {
+		return nil, err
+	}
+
+	p := &parser{name: name, toks: toks, h: &Header{Name: name, Defines: pp.defines()}}
+	for p.tok().kind != tokEOF {
+		if err := p.topLevel(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARN (%s) skipped declaration\n", err)
+		}
+	}
+
+	return p.h, nil
+}
+
+// ParseType parses the name of a C type, as in a cast: "const char *".
+func ParseType(s string) (*Type, error) {
+	toks, err := lex(s, s, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{name: fmt.Sprintf("type %q", s), toks: toks, h: &Header{}}
+	var t *Type
+	err = p.try(func() {
+		spec := p.specifiers()
+		var name string
+		if name, t = p.declarator(spec.typ); name != "" || p.tok().kind != tokEOF {
+			p.errorf("not a type")
+		}
+	})
+
+	return t, err
+}
+
+type parseError struct {
+	err error
+}
+
+// parser turns tokens into declarations.
+type parser struct {
+	name    string
+	toks    []token
+	pos     int
+	linkage int // depth of extern "C" { blocks
+	h       *Header
+}
+
+func (p *parser) errorf(format string, a ...interface{}) {
+	panic(parseError{fmt.Errorf("%s:%d: %s", p.name, p.tok().line, fmt.Sprintf(format, a...))})
+}
+
+// try runs fn, returning the error it fails with.
+func (p *parser) try(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			err = pe.err
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+func (p *parser) tok() token {
+	return p.peek(0)
+}
+
+func (p *parser) peek(n int) token {
+	if p.pos+n < len(p.toks) {
+		return p.toks[p.pos+n]
+	}
+	return p.toks[len(p.toks)-1]
+}
+
+func (p *parser) next() token {
+	t := p.tok()
+	if p.pos < len(p.toks)-1 {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the current token is the punctuation or keyword s.
+func (p *parser) is(s string) bool {
+	t := p.tok()
+	return t.text == s && (t.kind == tokPunct || t.kind == tokIdent)
+}
+
+func (p *parser) accept(s string) bool {
+	if p.is(s) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) {
+	if !p.accept(s) {
+		p.errorf("expected %s, found %s", s, p.describe())
+	}
+}
+
+func (p *parser) describe() string {
+	if p.tok().kind == tokEOF {
+		return "end of file"
+	}
+	return fmt.Sprintf("%q", p.tok().text)
+}
+
+func (p *parser) add(d Decl) {
+	p.h.Decls = append(p.h.Decls, d)
+}
+
+// topLevel parses one declaration, skipping past it if it can't.
+func (p *parser) topLevel() error {
+	start := p.pos
+
+	err := p.try(p.declaration)
+	if err != nil {
+		p.pos = start
+		p.skipDecl()
+	}
+	return err
+}
+
+// skipDecl skips to the end of the declaration at hand.
+func (p *parser) skipDecl() {
+	start := p.pos
+	for p.tok().kind != tokEOF {
+		switch {
+		case p.accept(";"):
+			return
+		case p.is("}"):
+			// the end of an extern "C" block
+			if p.pos == start {
+				p.next()
+			}
+			return
+		case p.is("(") || p.is("[") || p.is("{"):
+			// a function body ends the declaration, a struct body doesn't
+			body := p.is("{") && p.pos > 0 && p.toks[p.pos-1].text == ")"
+			p.skipGroup()
+			if body {
+				return
+			}
+		default:
+			p.next()
+		}
+	}
+}
+
+// skipGroup skips a bracketed group of tokens, starting at the opening one,
+// or everything if it isn't closed.
+func (p *parser) skipGroup() {
+	depth := 0
+	for p.tok().kind != tokEOF {
+		switch {
+		case p.is("(") || p.is("[") || p.is("{"):
+			depth++
+		case p.is(")") || p.is("]") || p.is("}"):
+			depth--
+		}
+		p.next()
+		if depth == 0 {
+			return
+		}
+	}
+}
+
+// skipUntil skips tokens up to, but not including, any of stops outside
+// brackets, returning them.
+func (p *parser) skipUntil(stops ...string) []token {
+	var toks []token
+	for {
+		for _, s := range stops {
+			if p.is(s) {
+				return toks
+			}
+		}
+		switch {
+		case p.tok().kind == tokEOF:
+			p.errorf("unexpected end of file")
+		case p.is("(") || p.is("[") || p.is("{"):
+			start := p.pos
+			p.skipGroup()
+			toks = append(toks, p.toks[start:p.pos]...)
+		default:
+			toks = append(toks, p.next())
+		}
+	}
+}
+
+// attributes skips __attribute__((...)), calling conventions and the like.
+func (p *parser) attributes() {
+	for {
+		switch p.tok().text {
+		case "__attribute__", "__attribute", "__declspec", "__asm__", "__asm", "asm", "_Alignas", "alignas":
+			p.next()
+			if p.is("(") {
+				p.skipGroup()
+			}
+		case "__cdecl", "__stdcall", "__fastcall", "__extension__":
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+// qualifier skips a type qualifier, reporting whether it was const.
+func (p *parser) qualifier() (isConst, ok bool) {
+	switch p.tok().text {
+	case "const", "__const", "__const__":
+		p.next()
+		return true, true
+	case "volatile", "__volatile", "__volatile__", "restrict", "__restrict", "__restrict__", "_Atomic":
+		p.next()
+		return false, true
+	}
+	return false, false
+}
+
+func (p *parser) declaration() {
+	t := p.tok()
+	comment, line := t.comment, t.line
+
+	switch {
+	case p.accept(";"):
+		return
+	case p.is("extern") && p.peek(1).kind == tokString:
+		// extern "C"
+		p.next()
+		p.next()
+		if p.accept("{") {
+			p.linkage++
+		} else if p.tok().comment == nil {
+			p.toks[p.pos].comment = comment
+		}
+		return
+	case p.is("}") && p.linkage > 0:
+		p.next()
+		p.linkage--
+		return
+	case p.is("_Static_assert") || p.is("static_assert"):
+		p.next()
+		p.skipGroup()
+		p.expect(";")
+		return
+	}
+
+	spec := p.specifiers()
+	if p.accept(";") {
+		// just a struct, union or enum
+		return
+	}
+
+	for {
+		name, typ := p.declarator(spec.typ)
+		if name == "" {
+			p.errorf("expected a name, found %s", p.describe())
+		}
+		p.attributes()
+
+		switch {
+		case spec.typedef:
+			p.add(&Typedef{Name: name, Type: typ, Comment: comment, Line: line})
+		case typ.Kind == Function:
+			f := &Func{Name: name, Result: typ.Elem, Params: typ.Params, Variadic: typ.Variadic,
+				Static: spec.static, Inline: spec.inline, Comment: comment, Line: line}
+			p.add(f)
+			if p.is("{") {
+				p.skipGroup()
+				f.Body = true
+				return
+			}
+		default:
+			p.add(&Var{Name: name, Type: typ, Extern: spec.extern, Static: spec.static, Comment: comment, Line: line})
+			if p.accept("=") {
+				p.skipUntil(",", ";")
+			}
+		}
+
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	p.expect(";")
+}
+
+// specs are the declaration specifiers: the base type and storage class.
+type specs struct {
+	typ     *Type
+	typedef bool
+	extern  bool
+	static  bool
+	inline  bool
+}
+
+func (p *parser) specifiers() specs {
+	var s specs
+	var words []string // int, unsigned and so on
+	var name string    // a typedef name
+	isConst := false
+	comment, line := p.tok().comment, p.tok().line
+
+loop:
+	for {
+		if c, ok := p.qualifier(); ok {
+			isConst = isConst || c
+			continue
+		}
+
+		t := p.tok()
+		if t.kind != tokIdent {
+			break
+		}
+
+		switch t.text {
+		case "typedef":
+			s.typedef = true
+		case "extern":
+			s.extern = true
+		case "static":
+			s.static = true
+		case "inline", "__inline", "__inline__":
+			s.inline = true
+		case "register", "auto", "_Noreturn", "_Thread_local", "__thread":
+		case "__attribute__", "__attribute", "__declspec", "__asm__", "__asm", "asm", "_Alignas", "alignas",
+			"__cdecl", "__stdcall", "__fastcall", "__extension__":
+			p.attributes()
+			continue
+		case "void", "char", "short", "int", "long", "float", "double", "signed", "__signed", "__signed__",
+			"unsigned", "_Bool", "bool", "_Complex", "__int128":
+			words = append(words, t.text)
+		case "struct", "union":
+			if s.typ != nil {
+				break loop
+			}
+			p.next()
+			s.typ = p.structSpec(t.text, comment, line)
+			continue
+		case "enum":
+			if s.typ != nil {
+				break loop
+			}
+			p.next()
+			s.typ = p.enumSpec(comment, line)
+			continue
+		default:
+			if name != "" || len(words) > 0 || s.typ != nil {
+				break loop
+			}
+			name = t.text
+		}
+		p.next()
+	}
+
+	// a name before a type keyword is most likely a macro from a header
+	// we haven't read, as in LIBFOO_API int foo(void)
+	switch {
+	case s.typ != nil:
+	case len(words) > 0:
+		s.typ = &Type{Name: basicName(words)}
+	case name != "":
+		s.typ = &Type{Name: name}
+	default:
+		p.errorf("expected a type, found %s", p.describe())
+	}
+	s.typ.Const = isConst
+
+	return s
+}
+
+// basicName is the usual spelling of a type made of keywords, e.g.
+// "unsigned long" for long unsigned int.
+func basicName(words []string) string {
+	var unsigned, signed, short bool
+	long := 0
+	base := ""
+
+	for _, w := range words {
+		switch w {
+		case "unsigned":
+			unsigned = true
+		case "signed", "__signed", "__signed__":
+			signed = true
+		case "short":
+			short = true
+		case "long":
+			long++
+		case "int":
+		default:
+			if base != "" {
+				base += " "
+			}
+			base += w
+		}
+	}
+
+	switch {
+	case base == "char":
+	case base == "double" && long > 0:
+		return "long double"
+	case base != "":
+		return base
+	case short:
+		base = "short"
+	case long == 1:
+		base = "long"
+	case long > 1:
+		base = "long long"
+	default:
+		base = "int"
+	}
+
+	switch {
+	case unsigned:
+		return "unsigned " + base
+	case signed && base == "char":
+		return "signed char"
+	}
+	return base
+}
+
+// structSpec parses what follows struct or union in a type.
+func (p *parser) structSpec(kind string, comment []string, line int) *Type {
+	t := &Type{Name: kind}
+	p.attributes()
+	tag := ""
+	if p.tok().kind == tokIdent {
+		tag = p.next().text
+		t.Name += " " + tag
+	}
+	p.attributes()
+	if !p.accept("{") {
+		return t
+	}
+
+	st := &Struct{Name: tag, Union: kind == "union", Comment: comment, Line: line}
+	for !p.accept("}") {
+		fcomment := p.tok().comment
+		spec := p.specifiers()
+		if p.accept(";") {
+			st.Fields = append(st.Fields, Field{Type: spec.typ, Comment: fcomment})
+			continue
+		}
+
+		for {
+			f := Field{Type: spec.typ, Comment: fcomment}
+			if !p.is(":") {
+				f.Name, f.Type = p.declarator(spec.typ)
+			}
+			if p.accept(":") {
+				f.Bits = joinTokens(p.skipUntil(",", ";"))
+			}
+			p.attributes()
+			st.Fields = append(st.Fields, f)
+			if !p.accept(",") {
+				break
+			}
+		}
+		p.expect(";")
+	}
+	p.attributes()
+
+	t.Struct = st
+	p.add(st)
+	return t
+}
+
+// enumSpec parses what follows enum in a type.
+func (p *parser) enumSpec(comment []string, line int) *Type {
+	t := &Type{Name: "enum"}
+	p.attributes()
+	tag := ""
+	if p.tok().kind == tokIdent {
+		tag = p.next().text
+		t.Name += " " + tag
+	}
+	p.attributes()
+	// enum foo : int, as C23 allows
+	if p.accept(":") {
+		p.skipUntil("{", ";", ")", ",")
+	}
+	if !p.accept("{") {
+		return t
+	}
+
+	e := &Enum{Name: tag, Comment: comment, Line: line}
+	for !p.accept("}") {
+		if p.tok().kind != tokIdent {
+			p.errorf("expected an enumeration constant, found %s", p.describe())
+		}
+		v := EnumValue{Comment: p.tok().comment, Name: p.next().text}
+		p.attributes()
+		if p.accept("=") {
+			v.Expr = joinTokens(p.skipUntil(",", "}"))
+		}
+		e.Values = append(e.Values, v)
+		if !p.accept(",") {
+			p.expect("}")
+			break
+		}
+	}
+	p.attributes()
+
+	t.Enum = e
+	p.add(e)
+	return t
+}
+
+// declarator parses a declarator of a base type, returning the name it
+// declares, empty for an abstract one, and its type.
+func (p *parser) declarator(base *Type) (string, *Type) {
+	t := base
+	for {
+		p.attributes()
+		if !p.accept("*") && !p.accept("^") {
+			break
+		}
+		t = &Type{Kind: Pointer, Elem: t}
+		for {
+			c, ok := p.qualifier()
+			if !ok {
+				break
+			}
+			t.Const = t.Const || c
+		}
+	}
+	p.attributes()
+
+	switch {
+	case p.tok().kind == tokIdent:
+		return p.next().text, p.suffixes(t)
+	case p.is("(") && (p.peek(1).text == "*" || p.peek(1).text == "^" || p.peek(1).text == "__cdecl" ||
+		p.peek(1).text == "__stdcall" || p.peek(1).text == "(" || p.peek(1).kind == tokIdent && p.peek(2).text == ")"):
+		// a declarator in parentheses, as in (*callback)(int). What
+		// follows the parentheses applies first, so the inner declarator
+		// is built around a hole that is filled in after.
+		p.next()
+		hole := &Type{}
+		name, inner := p.declarator(hole)
+		p.expect(")")
+		*hole = *p.suffixes(t)
+		return name, inner
+	}
+
+	return "", p.suffixes(t)
+}
+
+// suffixes parses any array and function suffixes of a declarator.
+func (p *parser) suffixes(t *Type) *Type {
+	var chain []*Type
+
+	for {
+		switch {
+		case p.accept("["):
+			chain = append(chain, &Type{Kind: Array, Len: joinTokens(p.skipUntil("]"))})
+			p.expect("]")
+			continue
+		case p.accept("("):
+			f := &Type{Kind: Function}
+			f.Params, f.Variadic = p.params()
+			chain = append(chain, f)
+			continue
+		}
+		break
+	}
+
+	// int a[2][3] is an array of two arrays of three ints
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i].Elem = t
+		t = chain[i]
+	}
+	return t
+}
+
+// params parses a parameter list after the (.
+func (p *parser) params() (ps []Param, variadic bool) {
+	if p.accept(")") {
+		return nil, false
+	}
+	if p.is("void") && p.peek(1).text == ")" {
+		p.next()
+		p.next()
+		return nil, false
+	}
+
+	for {
+		if p.accept("...") {
+			p.expect(")")
+			return ps, true
+		}
+
+		spec := p.specifiers()
+		name, t := p.declarator(spec.typ)
+		p.attributes()
+
+		// parameters of array and function type are really pointers
+		switch t.Kind {
+		case Array:
+			t = &Type{Kind: Pointer, Elem: t.Elem}
+		case Function:
+			t = &Type{Kind: Pointer, Elem: t}
+		}
+
+		ps = append(ps, Param{Type: t, Name: name})
+		if p.accept(")") {
+			return ps, false
+		}
+		p.expect(",")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// named spells a declaration of name as type t, e.g. "const char* s" or
+// "void(*)(int) cb".
+func named(t *Type, name string) string {
+	s := strings.TrimSpace(t.String())
+	if name == "" {
+		return s
+	}
+	return s + " " + name
+}
+
+// summary spells each declaration in h on a line of its own, roughly as C
+// would, so tests can compare them as text.
+func summary(h *Header) string {
+	var lines []string
+	for _, d := range h.Decls {
+		switch d := d.(type) {
+		case *Func:
+			var ps []string
+			for _, p := range d.Params {
+				ps = append(ps, named(p.Type, p.Name))
+			}
+			if d.Variadic {
+				ps = append(ps, "...")
+			}
+			s := named(d.Result, d.Name) + "(" + strings.Join(ps, ", ") + ")"
+			if d.Inline {
+				s = "inline " + s
+			}
+			if d.Static {
+				s = "static " + s
+			}
+			if d.Body {
+				s += " {}"
+			}
+			lines = append(lines, s)
+		case *Var:
+			s := named(d.Type, d.Name)
+			if d.Extern {
+				s = "extern " + s
+			}
+			lines = append(lines, s)
+		case *Typedef:
+			lines = append(lines, "typedef "+named(d.Type, d.Name))
+		case *Struct:
+			var fs []string
+			for _, f := range d.Fields {
+				fs = append(fs, named(f.Type, f.Name)+";")
+			}
+			kind := "struct"
+			if d.Union {
+				kind = "union"
+			}
+			lines = append(lines, fmt.Sprintf("%s %s {%s}", kind, d.Name, strings.Join(fs, " ")))
+		case *Enum:
+			var vs []string
+			for _, v := range d.Values {
+				if v.Expr != "" {
+					vs = append(vs, v.Name+" = "+v.Expr)
+				} else {
+					vs = append(vs, v.Name)
+				}
+			}
+			lines = append(lines, fmt.Sprintf("enum %s {%s}", d.Name, strings.Join(vs, ", ")))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			"multi-line prototype",
+			`int
+frob(const char *name,
+     unsigned int flags,
+     struct foo *out);`,
+			"int frob(const char* name, unsigned int flags, struct foo* out)",
+		},
+		{
+			"basic types",
+			`unsigned u(unsigned x);
+long int l(short unsigned s, long long ll, unsigned long long ull);
+signed char sc(char const *s, const unsigned char *us);`,
+			`unsigned int u(unsigned int x)
+long l(unsigned short s, long long ll, unsigned long long ull)
+signed char sc(const char* s, const unsigned char* us)`,
+		},
+		{
+			"pointers",
+			`void put(char *const p, const char **argv, struct foo *const *fs);`,
+			"void put(char* const p, const char** argv, struct foo* const * fs)",
+		},
+		{
+			"function pointer parameters",
+			`void sort(void *base, size_t n, int (*cmp)(const void *, const void *));
+void on(void (*cb)(int sig, void *arg), void *arg);`,
+			`void sort(void* base, size_t n, int(*)(const void*, const void*) cmp)
+void on(void(*)(int, void*) cb, void* arg)`,
+		},
+		{
+			"variadic",
+			`int logf(int level, const char *fmt, ...);
+int none(void);
+int unspecified();`,
+			`int logf(int level, const char* fmt, ...)
+int none()
+int unspecified()`,
+		},
+		{
+			"static inline body",
+			`static inline int add(int a, int b) {
+	if (a) { return a + b; }
+	return (b ? 1 : 0);
+}
+int after(void);`,
+			`static inline int add(int a, int b) {}
+int after()`,
+		},
+		{
+			"typedefs",
+			`typedef unsigned int uint;
+typedef struct foo { int x; const char *name; } foo_t;
+typedef void (*handler)(int);
+typedef int vec[4];
+uint use(foo_t *f, handler h, vec v);`,
+			`typedef unsigned int uint
+struct foo {int x; const char* name;}
+typedef struct foo foo_t
+typedef void(*)(int) handler
+typedef int[4] vec
+uint use(foo_t* f, handler h, vec v)`,
+		},
+		{
+			"variables",
+			`extern const char *version;
+extern int counts[16], total;`,
+			`extern const char* version
+extern int[16] counts
+extern int total`,
+		},
+		{
+			"struct, union and enum",
+			`struct point { int x, y; };
+union val { long l; double d; };
+enum color { RED, GREEN = 4, BLUE };`,
+			`struct point {int x; int y;}
+union val {long l; double d;}
+enum color {RED, GREEN = 4, BLUE}`,
+		},
+	}
+
+	for _, tt := range tests {
+		h, err := ParseHeader(tt.name, []byte(tt.src), nil)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got := summary(h); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseHeaderConditionals(t *testing.T) {
+	src := `#ifdef USE_A
+int a(void);
+#elif defined(USE_B) && USE_B > 1
+int b(void);
+#elif USE_C
+int c(void);
+#else
+int other(void);
+#endif
+#ifndef NO_COMMON
+int common(void);
+#endif`
+
+	tests := []struct {
+		defines map[string]string
+		want    string
+	}{
+		{nil, "int other()\nint common()"},
+		{map[string]string{"USE_A": ""}, "int a()\nint common()"},
+		{map[string]string{"USE_A": "", "USE_B": "2"}, "int a()\nint common()"},
+		{map[string]string{"USE_B": "2"}, "int b()\nint common()"},
+		{map[string]string{"USE_B": "1"}, "int other()\nint common()"},
+		{map[string]string{"USE_B": "1", "USE_C": "1"}, "int c()\nint common()"},
+		{map[string]string{"USE_C": "0", "NO_COMMON": ""}, "int other()"},
+	}
+
+	for _, tt := range tests {
+		h, err := ParseHeader("cond.h", []byte(src), tt.defines)
+		if err != nil {
+			t.Errorf("%v: %s", tt.defines, err)
+			continue
+		}
+		if got := summary(h); got != tt.want {
+			t.Errorf("%v: got\n%s\nwant\n%s", tt.defines, got, tt.want)
+		}
+	}
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"const char *", "const char*"},
+		{"unsigned", "unsigned int"},
+		{"struct foo *", "struct foo*"},
+		{"int (*)(void *)", "int(*)(void*)"},
+		{"char *[3]", "char*[3]"},
+	}
+	for _, tt := range tests {
+		typ, err := ParseType(tt.src)
+		if err != nil {
+			t.Errorf("%q: %s", tt.src, err)
+			continue
+		}
+		if got := typ.String(); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"int x", "int;", ""} {
+		if typ, err := ParseType(s); err == nil {
+			t.Errorf("%q: parsed as %s", s, typ)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+)
+
+// TypeMap says how values of a C type are passed between Go and C. In, Arg,
+// Free and Out are text/template code with these fields:
+//
+//	.Go      the Go variable
+//	.C       the C variable
+//	.GoType  the Go type
+//	.CType   the cgo type, e.g. C.uint
+type TypeMap struct {
+	C  string `json:"c"`  // the C type, e.g. "unsigned int" or "const char *"
+	Go string `json:"go"` // the Go type, empty for void
+
+	// In declares the C variable and sets it from the Go one before a
+	// call. It is {{.C}} := {{.CType}}({{.Go}}) by default.
+	In string `json:"in"`
+
+	// Arg is what is passed to the C function, {{.C}} by default.
+	Arg string `json:"arg"`
+
+	// Free releases anything In allocated, once C is done with it.
+	Free string `json:"free"`
+
+	// Out is the expression that turns a C result into Go, by default
+	// {{.GoType}}({{.C}}).
+	Out string `json:"out"`
+
+	in, arg, free, out *template.Template
+}
+
+// builtinTypes are the types goch knows without a -types file. Pointers to
+// other types are passed as they are, as cgo pointers.
+var builtinTypes = []TypeMap{
+	{C: "void"},
+
+	{C: "char", Go: "byte"},
+	{C: "signed char", Go: "int8"},
+	{C: "unsigned char", Go: "byte"},
+	{C: "short", Go: "int16"},
+	{C: "unsigned short", Go: "uint16"},
+	{C: "int", Go: "int"},
+	{C: "unsigned int", Go: "uint"},
+	{C: "long", Go: "int"},
+	{C: "unsigned long", Go: "uint"},
+	{C: "long long", Go: "int64"},
+	{C: "unsigned long long", Go: "uint64"},
+	{C: "float", Go: "float32"},
+	{C: "double", Go: "float64"},
+	{C: "_Bool", Go: "bool"},
+	{C: "bool", Go: "bool"},
+
+	{C: "int8_t", Go: "int8"},
+	{C: "int16_t", Go: "int16"},
+	{C: "int32_t", Go: "int32"},
+	{C: "int64_t", Go: "int64"},
+	{C: "uint8_t", Go: "uint8"},
+	{C: "uint16_t", Go: "uint16"},
+	{C: "uint32_t", Go: "uint32"},
+	{C: "uint64_t", Go: "uint64"},
+	{C: "intptr_t", Go: "int"},
+	{C: "uintptr_t", Go: "uintptr"},
+	{C: "size_t", Go: "uint"},
+	{C: "ssize_t", Go: "int"},
+	{C: "ptrdiff_t", Go: "int"},
+
+	{C: "void*", Go: "unsafe.Pointer", In: "{{.C}} := {{.Go}}", Out: "{{.C}}"},
+
+	{
+		C:    "char*",
+		Go:   "string",
+		In:   "{{.C}} := C.CString({{.Go}})",
+		Free: "C.free(unsafe.Pointer({{.C}}))",
+		Out:  "C.GoString({{.C}})", // a copy, so ownership doesn't get confused
+	},
+
+	// a NULL terminated array of strings, as argv is
+	{
+		C:  "char**",
+		Go: "[]string",
+		In: `{{.C}} := make([]*C.char, len({{.Go}})+1)
+for i, s := range {{.Go}} {
+	{{.C}}[i] = C.CString(s)
+}`,
+		Arg: "&{{.C}}[0]",
+		Free: `for _, s := range {{.C}} {
+	C.free(unsafe.Pointer(s))
+}`,
+		Out: `func() (l []string) {
+	for p := {{.C}}; p != nil && *p != nil; p = (**C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + unsafe.Sizeof(*p))) {
+		l = append(l, C.GoString(*p))
+	}
+	return l
+}()`,
+	},
+}
+
+// types are the known types, by Type.String. Types with qualifiers that
+// aren't there are looked up without them.
+var types = map[string]*TypeMap{}
+
+func init() {
+	if err := addTypes(builtinTypes); err != nil {
+		panic(err)
+	}
+}
+
+// addTypes adds ms to types, replacing any already there.
+func addTypes(ms []TypeMap) error {
+	for _, m := range ms {
+		m := m
+
+		t, err := ParseType(m.C)
+		if err != nil {
+			return err
+		}
+
+		if m.In == "" {
+			m.In = "{{.C}} := {{.CType}}({{.Go}})"
+		}
+		if m.Arg == "" {
+			m.Arg = "{{.C}}"
+		}
+		if m.Out == "" {
+			m.Out = "{{.GoType}}({{.C}})"
+		}
+
+		name := t.String()
+		if m.in, err = template.New(name + " in").Parse(m.In); err != nil {
+			return err
+		}
+		if m.arg, err = template.New(name + " arg").Parse(m.Arg); err != nil {
+			return err
+		}
+		if m.free, err = template.New(name + " free").Parse(m.Free); err != nil {
+			return err
+		}
+		if m.out, err = template.New(name + " out").Parse(m.Out); err != nil {
+			return err
+		}
+
+		types[name] = &m
+	}
+
+	return nil
+}
+
+// loadTypes reads a JSON array of TypeMaps from the file name into types,
+// e.g.
+//
+//	[
+//		{"c": "my_bool", "go": "bool", "in": "{{.C}} := C.my_bool(0)\nif {{.Go}} {\n\t{{.C}} = 1\n}", "out": "{{.C}} != 0"},
+//		{"c": "time_t", "go": "int64"}
+//	]
+func loadTypes(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var ms []TypeMap
+	if err = json.Unmarshal(b, &ms); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	if err = addTypes(ms); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	return nil
+}
+
+// conv is how a particular type is passed between Go and C.
+type conv struct {
+	*TypeMap
+	CType string
+}
+
+func (c conv) expand(t *template.Template, goVar, cVar string) string {
+	var b bytes.Buffer
+	data := map[string]string{"Go": goVar, "C": cVar, "GoType": c.Go, "CType": c.CType}
+	if err := t.Execute(&b, data); err != nil {
+		Fatalln(err)
+	}
+	return b.String()
+}
+
+// in is the code converting the Go variable goVar to the C variable cVar.
+func (c conv) in(goVar, cVar string) string { return c.expand(c.TypeMap.in, goVar, cVar) }
+
+// arg is what passes cVar to C.
+func (c conv) arg(cVar string) string { return c.expand(c.TypeMap.arg, "", cVar) }
+
+// free is the code releasing what in allocated for goVar and cVar.
+func (c conv) free(goVar, cVar string) string { return c.expand(c.TypeMap.free, goVar, cVar) }
+
+// out is the expression converting the C value cVar to Go.
+func (c conv) out(cVar string) string { return c.expand(c.TypeMap.out, "", cVar) }
+
+// typedefs are the typedefs in the header being wrapped, by name.
+var typedefs = map[string]*Type{}
+
+// resolve follows typedefs from the header until t is something else.
+func resolve(t *Type) *Type {
+	for i := 0; i < 100 && t.Kind == Basic; i++ {
+		u, ok := typedefs[t.Name]
+		if !ok {
+			break
+		}
+		if t.Const && !u.Const {
+			c := *u
+			c.Const = true
+			u = &c
+		}
+		t = u
+	}
+	return t
+}
+
+// resolveAll is t with every typedef from the header in it resolved.
+func resolveAll(t *Type) *Type {
+	if t == nil {
+		return nil
+	}
+	u := *resolve(t)
+	u.Elem = resolveAll(u.Elem)
+	return &u
+}
+
+// known returns what types has for t, trying it with and without
+// qualifiers.
+func known(t *Type) (*TypeMap, bool) {
+	if m, ok := types[t.String()]; ok {
+		return m, true
+	}
+	m, ok := types[t.bare()]
+	return m, ok
+}
+
+// passThrough passes a value as the cgo type it is.
+var passThrough = &TypeMap{
+	in:   template.Must(template.New("in").Parse("{{.C}} := {{.Go}}")),
+	arg:  template.Must(template.New("arg").Parse("{{.C}}")),
+	free: template.Must(template.New("free").Parse("")),
+	out:  template.Must(template.New("out").Parse("{{.C}}")),
+}
+
+// lookupType finds how t is passed between Go and C.
+func lookupType(t *Type) (conv, error) {
+	if m, ok := known(t); ok {
+		return conv{m, cgoType(t)}, nil
+	}
+
+	u := resolveAll(t)
+	if m, ok := known(u); ok {
+		return conv{m, cgoType(t)}, nil
+	}
+
+	switch {
+	case u.uses(Function):
+		return conv{}, fmt.Errorf("function pointers are not supported")
+	case u.Kind == Basic && (u.Name == "struct" || u.Name == "union" || u.Name == "enum"):
+		return conv{}, fmt.Errorf("anonymous %s is not supported", u.Name)
+	case u.Kind == Pointer, u.Kind == Basic && (prefix(u.Name, "struct ") || prefix(u.Name, "union ")):
+		m := *passThrough
+		m.Go = cgoType(t)
+		return conv{&m, m.Go}, nil
+	case u.Kind == Basic && prefix(u.Name, "enum "):
+		return conv{types["int"], cgoType(t)}, nil
+	}
+
+	return conv{}, fmt.Errorf("no Go type for %s, give one with -types", t.bare())
+}
+
+// cgoNames are the cgo names of C's basic types.
+var cgoNames = map[string]string{
+	"char":               "C.char",
+	"signed char":        "C.schar",
+	"unsigned char":      "C.uchar",
+	"short":              "C.short",
+	"unsigned short":     "C.ushort",
+	"int":                "C.int",
+	"unsigned int":       "C.uint",
+	"long":               "C.long",
+	"unsigned long":      "C.ulong",
+	"long long":          "C.longlong",
+	"unsigned long long": "C.ulonglong",
+	"float":              "C.float",
+	"double":             "C.double",
+	"_Bool":              "C.bool",
+	"bool":               "C.bool",
+	"void":               "",
+}
+
+// cgoType is how cgo spells t.
+func cgoType(t *Type) string {
+	switch t.Kind {
+	case Pointer:
+		switch {
+		case t.Elem.Kind == Basic && t.Elem.Name == "void":
+			return "unsafe.Pointer"
+		case t.Elem.Kind == Function:
+			return "*[0]byte"
+		}
+		return "*" + cgoType(t.Elem)
+	case Array:
+		return "[" + t.Len + "]" + cgoType(t.Elem)
+	case Function:
+		return "[0]byte"
+	}
+
+	if n, ok := cgoNames[t.Name]; ok {
+		return n
+	}
+	for _, kind := range []string{"struct", "union", "enum"} {
+		if prefix(t.Name, kind+" ") {
+			return "C." + kind + "_" + t.Name[len(kind)+1:]
+		}
+	}
+	return "C." + t.Name
+}
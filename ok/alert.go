@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	statefile *string        = flag.String("state", "/var/tmp/ok.state", "file the last status of each check is kept in, so only changes are notified; empty to keep nothing between runs")
+	renotify  *time.Duration = flag.Duration("renotify", 4*time.Hour, "how often to remind about a problem that hasn't gone away; 0 never to")
+	notifiers *string        = flag.String("notify", "stdout", "comma separated notifiers: stdout, webhook, smtp")
+	webhook   *string        = flag.String("webhook", "", "URL the webhook notifier POSTs JSON to")
+	mailto    *string        = flag.String("mailto", "", "comma separated addresses the smtp notifier mails")
+	mailfrom  *string        = flag.String("mailfrom", "", "address the smtp notifier mails from (default ok@hostname)")
+)
+
+// Notification tells someone that a check changed status.
+type Notification struct {
+	Host     string    `json:"host"`
+	Check    string    `json:"check"`
+	Status   Status    `json:"status"`
+	Previous Status    `json:"previous"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+	Reminder bool      `json:"reminder,omitempty"` // the status hasn't changed
+}
+
+func (n Notification) String() string {
+	switch {
+	case n.Reminder:
+		return fmt.Sprintf("%s on %s is still %s: %s", n.Check, n.Host, n.Status, n.Message)
+	case n.Status == OK:
+		return fmt.Sprintf("%s on %s has recovered from %s: %s", n.Check, n.Host, n.Previous, n.Message)
+	}
+	return fmt.Sprintf("%s on %s is %s (was %s): %s", n.Check, n.Host, n.Status, n.Previous, n.Message)
+}
+
+// Notifier passes notifications on to people.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// stdoutNotifier prints notifications.
+type stdoutNotifier struct{}
+
+func (stdoutNotifier) Notify(n Notification) error {
+	return warn(n.String())
+}
+
+// webhookNotifier POSTs notifications as JSON.
+type webhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w webhookNotifier) Notify(n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier mails notifications straight to each recipient's MX host, as
+// the mail command does, so no local MTA is needed.
+type smtpNotifier struct {
+	From string
+	To   []string
+}
+
+func (s smtpNotifier) Notify(n Notification) error {
+	var errs []string
+	for _, to := range s.To {
+		if err := s.send(to, n); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (s smtpNotifier) send(to string, n Notification) error {
+	mxhost, err := getMXHost(to)
+	if err != nil {
+		return fmt.Errorf("failed to find MX record for %s: %s", to, err)
+	}
+
+	c, err := smtp.Dial(mxhost + ":25")
+	if err != nil {
+		return fmt.Errorf("failed to connect to host (%s:25): %s", mxhost, err)
+	}
+	defer c.Quit()
+
+	if err = c.Mail(s.From); err != nil {
+		return fmt.Errorf("error occurred on %s while sending MAIL FROM for \"%s\": %s", mxhost, s.From, err)
+	}
+	if err = c.Rcpt(to); err != nil {
+		return fmt.Errorf("error occurred on %s while sending RCPT TO for \"%s\": %s", mxhost, to, err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("error occurred on %s while sending start of DATA: %s", mxhost, err)
+	}
+
+	subject := fmt.Sprintf("[ok] %s %s on %s", n.Check, n.Status, n.Host)
+	fmt.Fprintf(w, "Message-ID: <%d.%s.%s@%s>\r\n", n.Time.UnixNano(), n.Check, n.Status, n.Host)
+	fmt.Fprintf(w, "From: %s\r\n", s.From)
+	fmt.Fprintf(w, "To: %s\r\n", to)
+	fmt.Fprintf(w, "Subject: %s\r\n", subject)
+	fmt.Fprintf(w, "Date: %s\r\n\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "%s\r\n", n)
+
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("error occurred on %s while writing body of DATA: %s", mxhost, err)
+	}
+	return nil
+}
+
+// getMXHost returns an MX host for sending mail to the supplied address.
+func getMXHost(email string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", fmt.Errorf("%q is not an email address", email)
+	}
+
+	mx, err := net.LookupMX(email[at+1:])
+	if err != nil {
+		return "", err
+	}
+	if len(mx) == 0 {
+		return "", fmt.Errorf("no MX records")
+	}
+
+	return strings.TrimSuffix(mx[0].Host, "."), nil
+}
+
+// newNotifiers builds the notifiers named in -notify.
+func newNotifiers(host string) ([]Notifier, error) {
+	var ns []Notifier
+
+	for _, name := range strings.Split(*notifiers, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "stdout":
+			ns = append(ns, stdoutNotifier{})
+		case "webhook":
+			if *webhook == "" {
+				return nil, fmt.Errorf("the webhook notifier needs -webhook")
+			}
+			ns = append(ns, webhookNotifier{URL: *webhook, Client: &http.Client{Timeout: 10 * time.Second}})
+		case "smtp":
+			if *mailto == "" {
+				return nil, fmt.Errorf("the smtp notifier needs -mailto")
+			}
+			from := *mailfrom
+			if from == "" {
+				from = "ok@" + host
+			}
+			ns = append(ns, smtpNotifier{From: from, To: strings.Split(*mailto, ",")})
+		default:
+			return nil, fmt.Errorf("unknown notifier %q", name)
+		}
+	}
+
+	return ns, nil
+}
+
+// checkState is what is remembered about a check between runs.
+type checkState struct {
+	Status   Status    `json:"status"`
+	Since    time.Time `json:"since"`
+	Notified time.Time `json:"notified,omitempty"`
+}
+
+// alerter decides which results are worth telling anyone about.
+type alerter struct {
+	mu        sync.Mutex
+	host      string
+	path      string // empty if nothing is kept between runs
+	renotify  time.Duration
+	notifiers []Notifier
+	state     map[string]checkState
+}
+
+// newAlerter loads the state saved at path, if any.
+func newAlerter(host, path string, renotify time.Duration, ns []Notifier) (*alerter, error) {
+	a := &alerter{host: host, path: path, renotify: renotify, notifiers: ns, state: map[string]checkState{}}
+	if path == "" {
+		return a, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &a.state); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return a, nil
+}
+
+// Check notifies about r if check has changed status since last time, or
+// has been failing for longer than the re-notify interval. A change no
+// notifier could deliver isn't remembered, so it is notified again next time.
+func (a *alerter) Check(check string, r Result, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	prev, seen := a.state[check]
+	if !seen {
+		prev = checkState{Status: OK, Since: now}
+	}
+
+	n := Notification{Host: a.host, Check: check, Status: r.Status, Previous: prev.Status, Message: r.Message, Time: now}
+	next := prev
+	notify := false
+
+	switch {
+	case r.Status != prev.Status:
+		next = checkState{Status: r.Status, Since: now}
+		notify = true
+	case r.Status != OK && a.renotify > 0 && now.Sub(prev.Notified) >= a.renotify:
+		n.Reminder = true
+		notify = true
+	}
+
+	var errs []string
+	if notify {
+		delivered := len(a.notifiers) == 0
+		for _, nt := range a.notifiers {
+			if err := nt.Notify(n); err != nil {
+				errs = append(errs, err.Error())
+			} else {
+				delivered = true
+			}
+		}
+		if !delivered {
+			// nobody heard; leave the state alone so the next run tries again
+			return joinErrors(errs)
+		}
+		next.Notified = now
+	}
+
+	a.state[check] = next
+	if a.path != "" {
+		if err := a.save(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return joinErrors(errs)
+}
+
+// save writes the state out atomically; a.mu must be held.
+func (a *alerter) save() error {
+	b, err := json.MarshalIndent(a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(a.path, b)
+}
+
+func joinErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// setupAlerts builds the alerter configured by the command line.
+func setupAlerts(host string) (*alerter, error) {
+	ns, err := newNotifiers(host)
+	if err != nil {
+		return nil, err
+	}
+	return newAlerter(host, *statefile, *renotify, ns)
+}
+
+func logAlertError(check string, err error) {
+	if err != nil {
+		log.Println(check, "alert:", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifier keeps what it is told, failing to deliver it if fail is set.
+type fakeNotifier struct {
+	fail bool
+	got  []string
+}
+
+func (f *fakeNotifier) Notify(n Notification) error {
+	f.got = append(f.got, n.String())
+	if f.fail {
+		return errors.New("notifier down")
+	}
+	return nil
+}
+
+// take returns what f was told since last time.
+func (f *fakeNotifier) take() []string {
+	got := f.got
+	f.got = nil
+	return got
+}
+
+var alertEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestAlerterTransitions(t *testing.T) {
+	tests := []struct {
+		status  Status
+		minutes int
+		want    string // empty for no notification
+	}{
+		{OK, 0, ""},
+		{WARN, 10, "fs on h is WARN (was OK): m"},
+		{WARN, 20, ""},
+		{CRIT, 40, "fs on h is CRIT (was WARN): m"},
+		{CRIT, 90, ""},
+		// an hour after the last notification
+		{CRIT, 100, "fs on h is still CRIT: m"},
+		{CRIT, 130, ""},
+		{OK, 160, "fs on h has recovered from CRIT: m"},
+		// OK is never a problem worth a reminder
+		{OK, 300, ""},
+	}
+
+	f := &fakeNotifier{}
+	a, err := newAlerter("h", "", time.Hour, []Notifier{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		if err := a.Check("fs", Result{Status: tt.status, Message: "m"}, alertEpoch.Add(time.Duration(tt.minutes)*time.Minute)); err != nil {
+			t.Errorf("%s at %dm: %s", tt.status, tt.minutes, err)
+		}
+		got := strings.Join(f.take(), "; ")
+		if got != tt.want {
+			t.Errorf("%s at %dm: notified %q, want %q", tt.status, tt.minutes, got, tt.want)
+		}
+	}
+}
+
+func TestAlerterFirstRun(t *testing.T) {
+	tests := []struct {
+		status Status
+		want   int
+	}{
+		{OK, 0},
+		{WARN, 1},
+		{CRIT, 1},
+		{UNKNOWN, 1},
+	}
+
+	for _, tt := range tests {
+		f := &fakeNotifier{}
+		a, _ := newAlerter("h", "", 0, []Notifier{f})
+		a.Check("fs", Result{Status: tt.status}, alertEpoch)
+		// with -renotify 0 nothing is ever repeated
+		a.Check("fs", Result{Status: tt.status}, alertEpoch.Add(24*time.Hour))
+		if got := f.take(); len(got) != tt.want {
+			t.Errorf("%s: notified %q, want %d", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestAlerterFailedDelivery(t *testing.T) {
+	down, up := &fakeNotifier{fail: true}, &fakeNotifier{}
+	a, _ := newAlerter("h", "", time.Hour, []Notifier{down})
+	at := func(m int) time.Time { return alertEpoch.Add(time.Duration(m) * time.Minute) }
+
+	// nobody heard, so the change isn't remembered and is tried again
+	for _, m := range []int{0, 1} {
+		if err := a.Check("fs", Result{Status: CRIT, Message: "m"}, at(m)); err == nil {
+			t.Errorf("%dm: undelivered notification didn't fail", m)
+		}
+		if got := down.take(); len(got) != 1 || got[0] != "fs on h is CRIT (was OK): m" {
+			t.Errorf("%dm: notified %q, want the change again", m, got)
+		}
+	}
+	if _, ok := a.state["fs"]; ok {
+		t.Errorf("undelivered change remembered: %+v", a.state["fs"])
+	}
+
+	// one notifier getting through is enough
+	a.notifiers = []Notifier{down, up}
+	if err := a.Check("fs", Result{Status: CRIT, Message: "m"}, at(2)); err == nil {
+		t.Error("failing notifier's error lost")
+	}
+	if got := up.take(); len(got) != 1 {
+		t.Errorf("notified %q, want the change", got)
+	}
+	a.Check("fs", Result{Status: CRIT, Message: "m"}, at(3))
+	if got := append(down.take(), up.take()...); len(got) != 1 {
+		t.Errorf("notified %q after delivering, want nothing more", got)
+	}
+
+	// an undelivered reminder is tried again too
+	a.notifiers = []Notifier{down}
+	for _, m := range []int{62, 63} {
+		a.Check("fs", Result{Status: CRIT, Message: "m"}, at(m))
+		if got := down.take(); len(got) != 1 || got[0] != "fs on h is still CRIT: m" {
+			t.Errorf("%dm: notified %q, want a reminder", m, got)
+		}
+	}
+	if s := a.state["fs"]; !s.Notified.Equal(at(2)) {
+		t.Errorf("notified at %s, want %s", s.Notified, at(2))
+	}
+}
+
+func TestAlerterState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+
+	// nothing is saved until someone has been told
+	down := &fakeNotifier{fail: true}
+	a, err := newAlerter("h", path, time.Hour, []Notifier{down})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Check("fs", Result{Status: WARN}, alertEpoch)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state saved after a failed notification: %v", err)
+	}
+
+	f := &fakeNotifier{}
+	a.notifiers = []Notifier{f}
+	a.Check("fs", Result{Status: WARN}, alertEpoch)
+	a.Check("load", Result{Status: OK}, alertEpoch)
+
+	b, err := newAlerter("h", path, time.Hour, []Notifier{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.state) != len(a.state) {
+		t.Fatalf("loaded %+v, want %+v", b.state, a.state)
+	}
+	for check, want := range a.state {
+		got := b.state[check]
+		if got.Status != want.Status || !got.Since.Equal(want.Since) || !got.Notified.Equal(want.Notified) {
+			t.Errorf("%s: loaded %+v, want %+v", check, got, want)
+		}
+	}
+
+	// a new run picks up where the last left off
+	f.take()
+	b.Check("fs", Result{Status: WARN}, alertEpoch.Add(time.Minute))
+	b.Check("load", Result{Status: OK}, alertEpoch.Add(time.Minute))
+	if got := f.take(); len(got) != 0 {
+		t.Errorf("notified %q again after reloading", got)
+	}
+	b.Check("fs", Result{Status: OK, Message: "m"}, alertEpoch.Add(2*time.Minute))
+	if got := f.take(); len(got) != 1 || got[0] != "fs on h has recovered from WARN: m" {
+		t.Errorf("notified %q, want a recovery", got)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAlerter("h", path, time.Hour, nil); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("corrupt state file: err %v", err)
+	}
+}
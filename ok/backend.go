@@ -1,45 +1,251 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
-	influx "github.com/influxdb/influxdb/client"
+var (
+	influxurl *string = flag.String("influx", "", "InfluxDB URL to push metrics to, e.g. http://localhost:8086")
+	influxdb  *string = flag.String("influxdb", "ok", "InfluxDB database to push metrics to")
 )
 
+// Point is one line of time series data: a set of fields measured together
+// and the tags they are filed under.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	Time        time.Time
+}
+
+// Backend stores points somewhere for graphing. Writes may be buffered
+// until Close.
 type Backend interface {
+	Write(points ...Point) error
+	Close() error
+}
+
+// points groups the metrics of a check result that share tags into points,
+// measured as name and tagged with host.
+func points(name, host string, r Result, t time.Time) []Point {
+	var ps []Point
+	index := map[string]int{}
+
+	for _, m := range r.Metrics {
+		tags := map[string]string{"host": host}
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+
+		key := encodeTags(tags)
+		i, ok := index[key]
+		if !ok {
+			i = len(ps)
+			index[key] = i
+			ps = append(ps, Point{Measurement: name, Tags: tags, Fields: map[string]float64{}, Time: t})
+		}
+		ps[i].Fields[m.Name] = m.Value
+	}
+
+	return ps
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// encodeTags renders tags, sorted by key as InfluxDB prefers, with a leading
+// comma for each.
+func encodeTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		if tags[k] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, ",%s=%s", keyEscaper.Replace(k), keyEscaper.Replace(tags[k]))
+	}
+	return b.String()
+}
+
+var errNoFields = errors.New("point has no fields")
+
+// MarshalText encodes p in InfluxDB line protocol, without a newline. Fields
+// that are NaN or infinite, which InfluxDB would reject the whole line for,
+// are left out.
+func (p Point) MarshalText() ([]byte, error) {
+	keys := make([]string, 0, len(p.Fields))
+	for k, v := range p.Fields {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errNoFields
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString(measurementEscaper.Replace(p.Measurement))
+	b.WriteString(encodeTags(p.Tags))
+
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", keyEscaper.Replace(k), strconv.FormatFloat(p.Fields[k], 'f', -1, 64))
+	}
+
+	if !p.Time.IsZero() {
+		fmt.Fprintf(&b, " %d", p.Time.UnixNano())
+	}
+
+	return b.Bytes(), nil
 }
 
+// influxBackend writes to InfluxDB's HTTP API in batches.
 type influxBackend struct {
-	Host string
-	Port int
-	Conn *influx.Client
+	URL       string // e.g. http://localhost:8086
+	Database  string
+	Username  string
+	Password  string
+	BatchSize int
+
+	// Retries is how many more times a failed batch is sent, waiting
+	// Backoff and then twice as long again each time.
+	Retries int
+	Backoff time.Duration
+
+	Client *http.Client
+
+	buf []Point
+}
+
+// errPermanent marks a write that no amount of retrying will fix.
+type errPermanent struct {
+	error
+}
+
+// Write buffers points, sending them once a batch is full. A batch that
+// can't be sent is dropped.
+func (b *influxBackend) Write(points ...Point) error {
+	b.buf = append(b.buf, points...)
+
+	for len(b.buf) >= b.BatchSize {
+		batch := b.buf[:b.BatchSize]
+		b.buf = b.buf[b.BatchSize:]
+		if err := b.send(batch); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (b *influxBackend) Connect() (err error) {
-	var (
-		u *url.URL
-	)
+// Close sends whatever is still buffered.
+func (b *influxBackend) Close() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	err := b.send(b.buf)
+	b.buf = nil
+	return err
+}
+
+// send writes one batch, retrying if the server is unavailable. Points left
+// with no fields to send are skipped.
+func (b *influxBackend) send(batch []Point) error {
+	var body bytes.Buffer
+	for _, p := range batch {
+		line, err := p.MarshalText()
+		if err == errNoFields {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	if body.Len() == 0 {
+		return nil
+	}
 
-	if u, err = url.Parse(fmt.Sprintf("http://%s:%d", b.Host, b.Port)); err != nil {
-		return
+	wait := b.Backoff
+	for try := 0; ; try++ {
+		err := b.post(body.Bytes())
+		if _, permanent := err.(errPermanent); err == nil || permanent || try >= b.Retries {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (b *influxBackend) post(body []byte) error {
+	q := url.Values{"db": {b.Database}, "precision": {"ns"}}
+	req, err := http.NewRequest("POST", strings.TrimRight(b.URL, "/")+"/write?"+q.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if b.Username != "" {
+		req.SetBasicAuth(b.Username, b.Password)
 	}
 
-	conf := influx.Config{
-		URL:      *u,
-		Username: os.Getenv("INFLUX_USER"),
-		Password: os.Getenv("INFLUX_PWD"),
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	if b.Conn, err = influx.NewClient(conf); err != nil {
-		return
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
 	}
 
-	return
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("influx write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 4 {
+		// bad points or credentials; sending them again won't help
+		return errPermanent{err}
+	}
+	return err
 }
 
-func NewInfluxBackend(host string, port int) Backend {
-	b := &influxBackend{host, port, nil}
+// NewInfluxBackend writes to the database db of the InfluxDB server at
+// rawurl, logging in as $INFLUX_USER with $INFLUX_PWD if set.
+func NewInfluxBackend(rawurl, db string) Backend {
+	b := &influxBackend{
+		URL:       rawurl,
+		Database:  db,
+		Username:  os.Getenv("INFLUX_USER"),
+		Password:  os.Getenv("INFLUX_PWD"),
+		BatchSize: 500,
+		Retries:   3,
+		Backoff:   time.Second,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+	}
 	return b
 }
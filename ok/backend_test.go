@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxStub stands in for InfluxDB, answering each write with the next of
+// codes, or 204 once they run out, and keeping what was sent.
+type influxStub struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	codes  []int
+	bodies []string
+	times  []time.Time
+}
+
+func newInfluxStub(codes ...int) *influxStub {
+	s := &influxStub{codes: codes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if r.URL.Path != "/write" || r.URL.Query().Get("db") != "ok" || r.URL.Query().Get("precision") != "ns" {
+			http.Error(w, "bad url "+r.URL.String(), http.StatusNotFound)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		s.bodies = append(s.bodies, string(b))
+		s.times = append(s.times, time.Now())
+
+		code := http.StatusNoContent
+		if len(s.codes) > 0 {
+			code, s.codes = s.codes[0], s.codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	return s
+}
+
+func (s *influxStub) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func (s *influxStub) backend() *influxBackend {
+	b := NewInfluxBackend(s.URL, "ok").(*influxBackend)
+	b.Backoff = 10 * time.Millisecond
+	return b
+}
+
+func TestPointMarshalText(t *testing.T) {
+	at := time.Unix(1500000000, 123)
+
+	tests := []struct {
+		p    Point
+		want string
+	}{
+		{
+			Point{Measurement: "fs", Tags: map[string]string{"path": "/", "host": "a"}, Fields: map[string]float64{"pct": 83.5, "free": 100}, Time: at},
+			"fs,host=a,path=/ free=100,pct=83.5 1500000000000000123",
+		},
+		{
+			Point{Measurement: "disk usage,total", Tags: map[string]string{"path": `/mnt/my disk,a=b`}, Fields: map[string]float64{"x y": 1}},
+			`disk\ usage\,total,path=/mnt/my\ disk\,a\=b x\ y=1`,
+		},
+		{
+			Point{Measurement: "load", Tags: map[string]string{"host": "a", "cpu": ""}, Fields: map[string]float64{"load1": 0.25}, Time: at},
+			"load,host=a load1=0.25 1500000000000000123",
+		},
+		// InfluxDB refuses the whole line for any of these
+		{
+			Point{Measurement: "fs", Tags: map[string]string{"path": "/"}, Fields: map[string]float64{"total": 0, "pct": math.NaN(), "rate": math.Inf(1), "x": math.Inf(-1)}, Time: at},
+			"fs,path=/ total=0 1500000000000000123",
+		},
+	}
+
+	for _, tt := range tests {
+		b, err := tt.p.MarshalText()
+		if err != nil {
+			t.Errorf("%+v: %s", tt.p, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("got %s, want %s", b, tt.want)
+		}
+	}
+
+	for _, fields := range []map[string]float64{nil, {"pct": math.NaN()}} {
+		if b, err := (Point{Measurement: "fs", Fields: fields}).MarshalText(); err != errNoFields {
+			t.Errorf("%v: encoded %q, %v", fields, b, err)
+		}
+	}
+}
+
+func TestInfluxBatches(t *testing.T) {
+	s := newInfluxStub()
+	defer s.Close()
+	b := s.backend()
+	b.BatchSize = 2
+
+	at := time.Unix(1500000000, 0)
+	r := Result{Metrics: []Metric{
+		{Name: "pct", Tags: map[string]string{"path": "/"}, Value: 50},
+		{Name: "pct", Tags: map[string]string{"path": "/home"}, Value: 60},
+		{Name: "pct", Tags: map[string]string{"path": "/var"}, Value: 70},
+		{Name: "free", Tags: map[string]string{"path": "/"}, Value: 10},
+	}}
+	if err := b.Write(points("fs", "a", r, at)...); err != nil {
+		t.Fatal(err)
+	}
+
+	// the third point waits for another or for Close
+	if got := s.sent(); len(got) != 1 {
+		t.Fatalf("sent %d batches before Close, want 1", len(got))
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"fs,host=a,path=/ free=10,pct=50 1500000000000000000\nfs,host=a,path=/home pct=60 1500000000000000000\n",
+		"fs,host=a,path=/var pct=70 1500000000000000000\n",
+	}
+	got := s.sent()
+	if len(got) != len(want) {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("batch %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	// nothing left to send
+	if err := b.Close(); err != nil || len(s.sent()) != 2 {
+		t.Errorf("second Close sent again: %v", err)
+	}
+}
+
+func TestInfluxRetry(t *testing.T) {
+	tests := []struct {
+		codes   []int
+		retries int
+		tries   int
+		fails   bool
+	}{
+		{nil, 3, 1, false},
+		{[]int{503, 500}, 3, 3, false},
+		{[]int{503, 503, 503}, 2, 3, true},
+		{[]int{400}, 3, 1, true},
+		{[]int{401}, 3, 1, true},
+		{[]int{503, 404}, 3, 2, true},
+	}
+
+	for _, tt := range tests {
+		s := newInfluxStub(tt.codes...)
+		b := s.backend()
+		b.Retries = tt.retries
+		b.Write(Point{Measurement: "load", Fields: map[string]float64{"load1": 1}})
+
+		err := b.Close()
+		if (err != nil) != tt.fails {
+			t.Errorf("%v: err %v", tt.codes, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "influx write") {
+			t.Errorf("%v: err %q doesn't say what failed", tt.codes, err)
+		}
+
+		s.mu.Lock()
+		times := s.times
+		s.mu.Unlock()
+		if len(times) != tt.tries {
+			t.Errorf("%v: sent %d times, want %d", tt.codes, len(times), tt.tries)
+		}
+
+		// each wait is twice the one before
+		wait := b.Backoff
+		for i := 1; i < len(times); i++ {
+			if d := times[i].Sub(times[i-1]); d < wait {
+				t.Errorf("%v: retry %d after %s, want at least %s", tt.codes, i, d, wait)
+			}
+			wait *= 2
+		}
+		s.Close()
+	}
+}
+
+func TestInfluxSkipsNonFinite(t *testing.T) {
+	s := newInfluxStub()
+	defer s.Close()
+	b := s.backend()
+
+	// a zero-size filesystem has no percentage
+	at := time.Unix(1500000000, 0)
+	b.Write(
+		Point{Measurement: "fs", Tags: map[string]string{"path": "/boot"}, Fields: map[string]float64{"total": 0, "pct": math.NaN()}, Time: at},
+		Point{Measurement: "fs", Tags: map[string]string{"path": "/run"}, Fields: map[string]float64{"pct": math.NaN()}, Time: at},
+		Point{Measurement: "fs", Tags: map[string]string{"path": "/"}, Fields: map[string]float64{"pct": 50}, Time: at},
+	)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "fs,path=/boot total=0 1500000000000000000\nfs,path=/ pct=50 1500000000000000000\n"
+	if got := s.sent(); len(got) != 1 || got[0] != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	// nothing at all to send
+	b.Write(Point{Measurement: "fs", Fields: map[string]float64{"pct": math.Inf(1)}})
+	if err := b.Close(); err != nil || len(s.sent()) != 1 {
+		t.Errorf("sent %q, %v; want nothing more", s.sent(), err)
+	}
+}
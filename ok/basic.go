@@ -3,69 +3,229 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
-	"os/exec"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
 	fst *string = flag.String("fst", "60:80", "filesystem threshold (warn above fst usage)")
+	fsi *string = flag.String("fsi", "60:80", "inode threshold (warn above fsi inode usage)")
 )
 
-func checkfs() error {
-	findroots := exec.Command("cat", "/proc/mounts")
-	b, _ := findroots.Output()
+// readonlyTypes are filesystems that can only ever be mounted read-only.
+var readonlyTypes = map[string]bool{
+	"squashfs": true,
+	"iso9660":  true,
+	"udf":      true,
+	"erofs":    true,
+}
+
+func init() {
+	Register("fs", checkfs{})
+}
+
+// mount is a line of /proc/mounts or /etc/fstab.
+type mount struct {
+	dev, path, fstype string
+	opts              map[string]bool
+}
+
+func (m mount) readonly() bool {
+	return m.opts["ro"]
+}
+
+// unescapeMount undoes the octal escapes the kernel uses for whitespace and
+// backslashes in mount paths, e.g. "\040" for a space.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(c))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// parseMounts reads a mount table in fstab(5) format.
+func parseMounts(table string) []mount {
+	var mounts []mount
+	for _, line := range strings.Split(table, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		m := mount{dev: f[0], path: unescapeMount(f[1]), fstype: f[2], opts: map[string]bool{}}
+		for _, o := range strings.Split(f[3], ",") {
+			m.opts[o] = true
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
+
+// checkfs looks at the usage of every mounted block device.
+type checkfs struct{}
+
+func (checkfs) Run() Result {
+	b, err := readProc("mounts")
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
 	seen := map[string]bool{}
 
-	threshparts := strings.Split(*fst, ":")
-	wthresh, _ := strconv.ParseInt(threshparts[0], 10, 32)
-	cthresh, _ := strconv.ParseInt(threshparts[1], 10, 32)
+	// mounts fstab says are writable; anything else, a container's bind
+	// mounts or a USB stick say, may well be read-only on purpose
+	fstabrw := map[string]bool{}
+	if fstab, err := ioutil.ReadFile("/etc/fstab"); err == nil {
+		for _, m := range parseMounts(string(fstab)) {
+			fstabrw[m.path] = !m.readonly()
+		}
+	}
 
-	for _, root := range strings.Split(string(b), "\n") {
-		rootdev := strings.Split(root, " ")[0]
+	host := hostname()
+	r := Result{Status: OK}
+	var problems []string
 
-		if _, ok := seen[rootdev]; !strings.HasPrefix(root, "/dev/") || ok {
+	fwthresh, fcthresh, err := parseThresholds(*fillt)
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+
+	var history *usageHistory
+	if *historyfile != "" {
+		if history, err = loadHistory(*historyfile); err != nil {
+			r.Status = UNKNOWN
+			problems = append(problems, err.Error())
+		}
+	}
+	now := time.Now()
+	sampled := map[string]bool{}
+
+	for _, m := range parseMounts(b) {
+		if _, ok := seen[m.dev]; !strings.HasPrefix(m.dev, "/dev/") || ok || conf.excluded(m.path) {
 			continue
 		}
 
-		root = strings.Split(root, " ")[1]
-		root = strings.TrimSpace(root)
+		root := m.path
+
+		fsthresh, inodethresh := conf.mountThresholds(root)
+		wthresh, cthresh, err := parseThresholds(fsthresh)
+		if err != nil {
+			return Result{Status: UNKNOWN, Message: err.Error()}
+		}
+		iwthresh, icthresh, err := parseThresholds(inodethresh)
+		if err != nil {
+			return Result{Status: UNKNOWN, Message: err.Error()}
+		}
 
 		stats := &syscall.Statfs_t{}
 
 		if err := syscall.Statfs(root, stats); err != nil {
-			// if strings.Contains(err.Error(), "permission denied") {
-			// 	continue
-			// }
-			log.Fatal(err)
+			r.Status = r.Status.Worse(UNKNOWN)
+			problems = append(problems, fmt.Sprintf("disk %s: %s", root, err))
+			continue
 		}
 
 		total := stats.Blocks * uint64(stats.Frsize)
 		free := stats.Bavail * uint64(stats.Frsize)
 		pct := 100.0 / float64(total) * (float64(total) - float64(free))
 
-		seen[rootdev] = true
+		seen[m.dev] = true
 
-		if pct > float64(cthresh) {
-			warn("disk", root, "on", "gecko", "is critical:", fmt.Sprintf("%2.2f", pct)+"%")
-			continue
-		} else if pct > float64(wthresh) {
-			warn("disk", root, "on", "gecko", "is warning:", fmt.Sprintf("%2.2f", pct)+"%")
-			continue
+		tags := map[string]string{"path": root}
+		r.Metrics = append(r.Metrics,
+			Metric{Name: "total", Tags: tags, Value: float64(total), Unit: "B"},
+			Metric{Name: "free", Tags: tags, Value: float64(free), Unit: "B"},
+			Metric{Name: "pct", Tags: tags, Value: pct, Unit: "%",
+				Label: root, Warn: num(wthresh), Crit: num(cthresh), Min: num(0), Max: num(100)},
+		)
+
+		switch s := level(pct, wthresh, cthresh); s {
+		case CRIT:
+			problems = append(problems, fmt.Sprintf("disk %s on %s is critical: %2.2f%%", root, host, pct))
+			r.Status = r.Status.Worse(s)
+		case WARN:
+			problems = append(problems, fmt.Sprintf("disk %s on %s is warning: %2.2f%%", root, host, pct))
+			r.Status = r.Status.Worse(s)
+		}
+
+		// some filesystems, btrfs for one, have no fixed inode count
+		if stats.Files > 0 {
+			ipct := 100.0 / float64(stats.Files) * (float64(stats.Files) - float64(stats.Ffree))
+			r.Metrics = append(r.Metrics,
+				Metric{Name: "inodes_total", Tags: tags, Value: float64(stats.Files)},
+				Metric{Name: "inodes_free", Tags: tags, Value: float64(stats.Ffree)},
+				Metric{Name: "inodes_pct", Tags: tags, Value: ipct, Unit: "%",
+					Label: "inodes:" + root, Warn: num(iwthresh), Crit: num(icthresh), Min: num(0), Max: num(100)},
+			)
+
+			switch s := level(ipct, iwthresh, icthresh); s {
+			case CRIT:
+				problems = append(problems, fmt.Sprintf("inodes on %s on %s are critical: %2.2f%%", root, host, ipct))
+				r.Status = r.Status.Worse(s)
+			case WARN:
+				problems = append(problems, fmt.Sprintf("inodes on %s on %s are warning: %2.2f%%", root, host, ipct))
+				r.Status = r.Status.Worse(s)
+			}
+		}
+
+		// the kernel remounts read-only when it finds errors
+		ro := 0.0
+		if m.readonly() {
+			ro = 1
+			if conf.writable(root, fstabrw[root]) && !readonlyTypes[m.fstype] {
+				problems = append(problems, fmt.Sprintf("disk %s on %s is mounted read-only", root, host))
+				r.Status = r.Status.Worse(CRIT)
+			}
 		}
+		r.Metrics = append(r.Metrics, Metric{Name: "readonly", Tags: tags, Value: ro})
 
-		if *verbose {
-			if *human {
-				fmt.Printf("%s %s %s %2.2f", root, bytesToHuman(total), bytesToHuman(free), pct)
-				fmt.Println("%")
-			} else {
-				fmt.Printf("%s %d %d %1.4f\n", root, total, free, pct/100)
+		// a disk filling up fast is a problem however empty it is now
+		if history != nil && !m.readonly() {
+			history.add(root, now, total-free, total)
+			sampled[root] = true
+
+			if ttf, rate, ok := history.timeToFull(root); ok {
+				hours := ttf.Hours()
+				r.Metrics = append(r.Metrics,
+					Metric{Name: "growth_bytes_per_second", Tags: tags, Value: rate},
+					Metric{Name: "full_in", Tags: tags, Value: ttf.Seconds(), Unit: "s",
+						Label: "full:" + root, Warn: num(fwthresh * 3600), Crit: num(fcthresh * 3600), Min: num(0)},
+				)
+
+				if s := levelBelow(hours, fwthresh, fcthresh); s != OK {
+					problems = append(problems, fmt.Sprintf("disk %s on %s will be full in %s at %s/h", root, host,
+						ttf.Truncate(time.Minute), bytesToHuman(uint64(rate*3600))))
+					r.Status = r.Status.Worse(s)
+				}
 			}
 		}
+	}
+
+	if history != nil {
+		history.forget(sampled)
+		if err := history.save(); err != nil {
+			r.Status = r.Status.Worse(UNKNOWN)
+			problems = append(problems, err.Error())
+		}
+	}
 
+	if len(problems) == 0 {
+		r.Message = fmt.Sprintf("%d filesystems below their thresholds", len(seen))
+	} else {
+		r.Message = strings.Join(problems, ", ")
 	}
 
-	return nil
+	return r
 }
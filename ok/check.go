@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Status is the outcome of a check.
+type Status int
+
+const (
+	OK Status = iota
+	WARN
+	CRIT
+	UNKNOWN
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "OK"
+	case WARN:
+		return "WARN"
+	case CRIT:
+		return "CRIT"
+	}
+	return "UNKNOWN"
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Status) UnmarshalText(b []byte) error {
+	for _, t := range []Status{OK, WARN, CRIT, UNKNOWN} {
+		if t.String() == string(b) {
+			*s = t
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown status %q", b)
+}
+
+// severity orders statuses from best to worst; a check that couldn't run is
+// less alarming than one that found a real problem.
+func (s Status) severity() int {
+	switch s {
+	case OK:
+		return 0
+	case WARN:
+		return 1
+	case UNKNOWN:
+		return 2
+	}
+	return 3
+}
+
+// Worse returns whichever of s and t is the more serious.
+func (s Status) Worse(t Status) Status {
+	if t.severity() > s.severity() {
+		return t
+	}
+	return s
+}
+
+// Metric is a single value measured by a check.
+type Metric struct {
+	Name  string            `json:"name"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Value float64           `json:"value"`
+	Unit  string            `json:"unit,omitempty"` // "B", "%" or "" for a plain number
+
+	// Label names the metric in plugin perfdata; metrics without one are
+	// left out of it. Warn and Crit are the thresholds the value was
+	// graded against and Min and Max its range, nil if they don't apply.
+	Label string   `json:"-"`
+	Warn  *float64 `json:"warn,omitempty"`
+	Crit  *float64 `json:"crit,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// num is a convenience for filling in a Metric's thresholds.
+func num(v float64) *float64 {
+	return &v
+}
+
+// Result is what a check found.
+type Result struct {
+	Status  Status   `json:"status"`
+	Message string   `json:"message"`
+	Metrics []Metric `json:"metrics,omitempty"`
+}
+
+// Check is something ok can look at.
+type Check interface {
+	Run() Result
+}
+
+var (
+	checknames *string = flag.String("checks", "", "comma separated checks to run (default all that have something to check)")
+
+	registry = map[string]Check{}
+)
+
+// Register makes a check available under name.
+func Register(name string, c Check) {
+	if _, dup := registry[name]; dup {
+		panic("check registered twice: " + name)
+	}
+	registry[name] = c
+}
+
+// selected returns the names of the checks chosen with -checks, in order.
+func selected() ([]string, error) {
+	if *checknames == "" {
+		names := make([]string, 0, len(registry))
+		for name, c := range registry {
+			if idler, ok := c.(Idler); ok && idler.Idle() {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	names := strings.Split(*checknames, ",")
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		if _, ok := registry[names[i]]; !ok {
+			return nil, fmt.Errorf("unknown check %q", names[i])
+		}
+	}
+	return names, nil
+}
+
+// parseThresholds reads a "warn:crit" pair such as "60:80".
+func parseThresholds(s string) (warn, crit float64, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("bad threshold %q, want warn:crit", s)
+	}
+	if warn, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return
+	}
+	crit, err = strconv.ParseFloat(parts[1], 64)
+	return
+}
+
+// level grades value against warn and crit thresholds.
+func level(value, warn, crit float64) Status {
+	switch {
+	case value > crit:
+		return CRIT
+	case value > warn:
+		return WARN
+	}
+	return OK
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configfile *string = flag.String("config", "", "YAML or TOML (.toml) file of checks, thresholds and per-mount overrides; flags given on the command line win")
+)
+
+// Config is what can be set in the -config file, e.g.
+//
+//	hostname: web1
+//	checks: [fs, mem, load]
+//	thresholds:
+//	  fs: "60:80"
+//	  load: "2:4"
+//	exclude: [/boot, /snap/*]
+//	mounts:
+//	  /var/lib/docker:
+//	    fs: "90:95"
+//	  /srv/backup:
+//	    readonly: false
+//	processes:
+//	  - name: nginx
+//	    min: 2
+//	tcp: ["localhost:5432"]
+//	http:
+//	  - url: http://localhost/health
+type Config struct {
+	// Hostname is what this host is called in alerts and metrics; the
+	// system's hostname by default.
+	Hostname string `yaml:"hostname" toml:"hostname"`
+
+	// Checks are the checks to run, all of them by default.
+	Checks []string `yaml:"checks" toml:"checks"`
+
+	// Thresholds are the default "warn:crit" thresholds by check, see
+	// thresholdFlags.
+	Thresholds map[string]string `yaml:"thresholds" toml:"thresholds"`
+
+	// Exclude lists mount points, or patterns matching them, that checkfs
+	// ignores along with anything mounted beneath them.
+	Exclude []string `yaml:"exclude" toml:"exclude"`
+
+	// Mounts overrides the thresholds of particular mount points.
+	Mounts map[string]MountConfig `yaml:"mounts" toml:"mounts"`
+
+	// Processes, TCP and HTTP are what the procs, tcp and http checks
+	// look for when -procs, -tcp and -http aren't given.
+	Processes []ProcessConfig `yaml:"processes" toml:"processes"`
+	TCP       []string        `yaml:"tcp" toml:"tcp"`
+	HTTP      []HTTPConfig    `yaml:"http" toml:"http"`
+}
+
+// MountConfig overrides the fs and inode thresholds for one mount point.
+type MountConfig struct {
+	Exclude bool   `yaml:"exclude" toml:"exclude"`
+	FS      string `yaml:"fs" toml:"fs"`
+	Inodes  string `yaml:"inodes" toml:"inodes"`
+
+	// Readonly says whether the mount is meant to be read-only, as its
+	// /etc/fstab entry does otherwise. Mounts meant to be writable are
+	// critical when found read-only.
+	Readonly *bool `yaml:"readonly" toml:"readonly"`
+}
+
+// thresholdFlags maps the names used in Config.Thresholds to their flags.
+var thresholdFlags = map[string]string{
+	"fs":     "fst",
+	"inodes": "fsi",
+	"mem":    "memt",
+	"swap":   "swapt",
+	"load":   "loadt",
+	"iowait": "iowaitt",
+	"fill":   "fillt",
+}
+
+// conf is the loaded -config, empty if there is none.
+var conf = &Config{}
+
+// LoadConfig reads a config file, as TOML if it is named *.toml and as YAML
+// otherwise.
+func LoadConfig(name string) (*Config, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if strings.HasSuffix(name, ".toml") {
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), c)
+		// as strict as the YAML: a misspelt key shouldn't quietly do nothing
+		if keys := md.Undecoded(); err == nil && len(keys) > 0 {
+			var ks []string
+			for _, k := range keys {
+				ks = append(ks, k.String())
+			}
+			err = fmt.Errorf("unknown keys %s", strings.Join(ks, ", "))
+		}
+	} else {
+		err = yaml.UnmarshalStrict(b, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	for k, v := range c.Thresholds {
+		if _, ok := thresholdFlags[k]; !ok {
+			return nil, fmt.Errorf("%s: unknown threshold %q", name, k)
+		}
+		if _, _, err := parseThresholds(v); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	for p, m := range c.Mounts {
+		for _, t := range []string{m.FS, m.Inodes} {
+			if t == "" {
+				continue
+			}
+			if _, _, err := parseThresholds(t); err != nil {
+				return nil, fmt.Errorf("%s: mount %s: %s", name, p, err)
+			}
+		}
+	}
+	for _, p := range c.Processes {
+		if p.Name == "" && p.Cmdline == "" {
+			return nil, fmt.Errorf("%s: process needs a name or cmdline", name)
+		}
+	}
+	for _, pat := range c.Exclude {
+		if _, err := path.Match(pat, "/"); err != nil {
+			return nil, fmt.Errorf("%s: exclude %q: %s", name, pat, err)
+		}
+	}
+
+	return c, nil
+}
+
+// applyConfig loads -config, if given, and uses it for any flag that wasn't
+// set on the command line.
+func applyConfig() error {
+	if *configfile == "" {
+		return nil
+	}
+
+	c, err := LoadConfig(*configfile)
+	if err != nil {
+		return err
+	}
+	conf = c
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for k, v := range c.Thresholds {
+		if name := thresholdFlags[k]; !set[name] {
+			flag.Set(name, v)
+		}
+	}
+	if len(c.Checks) > 0 && !set["checks"] {
+		flag.Set("checks", strings.Join(c.Checks, ","))
+	}
+
+	return nil
+}
+
+// hostname is what this host is called in messages.
+func hostname() string {
+	if conf.Hostname != "" {
+		return conf.Hostname
+	}
+	h, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return h
+}
+
+// excluded reports whether checkfs should skip the mount point p.
+func (c *Config) excluded(p string) bool {
+	if m, ok := c.Mounts[p]; ok && m.Exclude {
+		return true
+	}
+	for _, pat := range c.Exclude {
+		// anything mounted beneath an excluded mount point goes too
+		for q := p; ; q = path.Dir(q) {
+			if ok, _ := path.Match(pat, q); ok {
+				return true
+			}
+			if q == "/" || q == "." {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// writable reports whether the mount point p is meant to be writable: as
+// its Mounts entry says, or else as fstab, whether /etc/fstab has it rw.
+func (c *Config) writable(p string, fstab bool) bool {
+	if m, ok := c.Mounts[p]; ok && m.Readonly != nil {
+		return !*m.Readonly
+	}
+	return fstab
+}
+
+// mountThresholds returns the fs and inode thresholds for the mount point p.
+func (c *Config) mountThresholds(p string) (fs, inodes string) {
+	fs, inodes = *fst, *fsi
+	if m, ok := c.Mounts[p]; ok {
+		if m.FS != "" {
+			fs = m.FS
+		}
+		if m.Inodes != "" {
+			inodes = m.Inodes
+		}
+	}
+	return
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	tests := []struct {
+		file string
+		src  string
+		bad  string // in the error, empty if it loads
+	}{
+		{"ok.toml", "checks = [\"fs\"]\n[mounts.\"/boot\"]\nexclude = true\n", ""},
+		{"top.toml", "checks = [\"fs\"]\ncheck = [\"load\"]\n", "check"},
+		{"nested.toml", "[mounts.\"/boot\"]\nexlude = true\n", "exlude"},
+		{"table.toml", "[[http]]\nurl = \"http://localhost/\"\nbogus = 1\n", "bogus"},
+		{"ok.yaml", "checks: [fs]\nmounts:\n  /boot:\n    exclude: true\n", ""},
+		{"top.yaml", "checks: [fs]\ncheck: [load]\n", "check"},
+		{"nested.yaml", "mounts:\n  /boot:\n    exlude: true\n", "exlude"},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.file)
+		if err := ioutil.WriteFile(name, []byte(tt.src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(name)
+		switch {
+		case tt.bad == "" && err != nil:
+			t.Errorf("%s: %s", tt.file, err)
+		case tt.bad != "" && (err == nil || !strings.Contains(err.Error(), tt.bad)):
+			t.Errorf("%s: err %v, want it to name %s", tt.file, err, tt.bad)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	daemon    *bool          = flag.Bool("daemon", false, "keep running the checks and serve the results over HTTP")
+	listen    *string        = flag.String("listen", ":9102", "address the daemon serves /status and /metrics on")
+	interval  *time.Duration = flag.Duration("interval", time.Minute, "how often the daemon runs each check")
+	intervals *string        = flag.String("intervals", "", "per check intervals overriding -interval, e.g. cpu=15s,fs=5m")
+)
+
+// lastRun is the most recent result of a check.
+type lastRun struct {
+	Result
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration"` // seconds
+}
+
+// results holds the latest outcome of every check the daemon runs.
+type results struct {
+	mu   sync.Mutex
+	host string
+	runs map[string]lastRun
+}
+
+func (rs *results) set(name string, run lastRun) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.runs[name] = run
+}
+
+// snapshot returns a copy of the latest results sorted by check name.
+func (rs *results) snapshot() ([]string, map[string]lastRun) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	names := make([]string, 0, len(rs.runs))
+	runs := make(map[string]lastRun, len(rs.runs))
+	for name, run := range rs.runs {
+		names = append(names, name)
+		runs[name] = run
+	}
+	sort.Strings(names)
+	return names, runs
+}
+
+// parseIntervals reads -intervals.
+func parseIntervals(s string) (map[string]time.Duration, error) {
+	every := map[string]time.Duration{}
+	if s == "" {
+		return every, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad interval %q, want check=duration", kv)
+		}
+		name := strings.TrimSpace(parts[0])
+		if _, ok := registry[name]; !ok {
+			return nil, fmt.Errorf("unknown check %q", name)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("interval for %s must be positive", name)
+		}
+		every[name] = d
+	}
+	return every, nil
+}
+
+// runDaemon runs each check in names on its own schedule forever, serving
+// the latest results over HTTP.
+func runDaemon(names []string, alerts *alerter) error {
+	every, err := parseIntervals(*intervals)
+	if err != nil {
+		return err
+	}
+
+	rs := &results{host: hostname(), runs: map[string]lastRun{}}
+
+	for _, name := range names {
+		d, ok := every[name]
+		if !ok {
+			d = *interval
+		}
+		go schedule(rs, alerts, name, d)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", rs.serveStatus)
+	mux.HandleFunc("/metrics", rs.serveMetrics)
+
+	log.Println("serving check results on", *listen)
+	return http.ListenAndServe(*listen, mux)
+}
+
+// schedule runs the check name every d, starting straight away.
+func schedule(rs *results, alerts *alerter, name string, d time.Duration) {
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+
+	for {
+		start := time.Now()
+		r := registry[name].Run()
+		rs.set(name, lastRun{Result: r, Time: start, Duration: time.Since(start).Seconds()})
+		logAlertError(name, alerts.Check(name, r, start))
+
+		if *influxurl != "" {
+			if err := push(NewInfluxBackend(*influxurl, *influxdb), []string{name}, []Result{r}); err != nil {
+				log.Println(name, err)
+			}
+		}
+
+		<-tick.C
+	}
+}
+
+// serveStatus reports every check as JSON. The response is a 503 while any
+// check is critical so load balancers can take the host out of service.
+func (rs *results) serveStatus(w http.ResponseWriter, req *http.Request) {
+	names, runs := rs.snapshot()
+
+	worst := OK
+	for _, name := range names {
+		worst = worst.Worse(runs[name].Status)
+	}
+
+	b, err := json.MarshalIndent(struct {
+		Host   string             `json:"host"`
+		Status Status             `json:"status"`
+		Checks map[string]lastRun `json:"checks"`
+	}{rs.host, worst, runs}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if worst == CRIT {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+var (
+	promInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// promName builds a Prometheus metric name for metric m of check.
+func promName(check string, m Metric) string {
+	name := "ok_" + check + "_" + m.Name
+	switch m.Unit {
+	case "B":
+		name += "_bytes"
+	case "%":
+		name += "_percent"
+	case "s":
+		name += "_seconds"
+	}
+	return promInvalid.ReplaceAllString(name, "_")
+}
+
+// promLabels renders labels as {k="v",...}, sorted by key.
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, promInvalid.ReplaceAllString(k, "_"), promEscaper.Replace(labels[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// serveMetrics reports every check in the Prometheus text format.
+func (rs *results) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	names, runs := rs.snapshot()
+
+	// samples of each metric must be written together
+	families := map[string][]string{}
+	help := map[string]string{}
+
+	add := func(name, desc string, labels map[string]string, v float64) {
+		families[name] = append(families[name], name+promLabels(labels)+" "+strconv.FormatFloat(v, 'g', -1, 64))
+		help[name] = desc
+	}
+
+	for _, name := range names {
+		run := runs[name]
+		check := map[string]string{"check": name}
+
+		add("ok_check_status", "Check status: 0 OK, 1 WARN, 2 CRIT, 3 UNKNOWN.", check, float64(run.Status))
+		add("ok_check_duration_seconds", "How long the check took to run.", check, run.Duration)
+		add("ok_check_last_run_timestamp_seconds", "When the check was last run.", check, float64(run.Time.Unix()))
+
+		for _, m := range run.Metrics {
+			add(promName(name, m), "Measured by the "+name+" check.", m.Tags, m.Value)
+		}
+	}
+
+	fams := make([]string, 0, len(families))
+	for name := range families {
+		fams = append(fams, name)
+	}
+	sort.Strings(fams)
+
+	var b bytes.Buffer
+	for _, name := range fams {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help[name], name)
+		for _, sample := range families[name] {
+			b.WriteString(sample)
+			b.WriteByte('\n')
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	procroot    *string        = flag.String("proc", "/proc", "where procfs is mounted")
+	memt        *string        = flag.String("memt", "80:90", "memory threshold (warn above memt percent in use)")
+	swapt       *string        = flag.String("swapt", "50:80", "swap threshold (warn above swapt percent in use)")
+	loadt       *string        = flag.String("loadt", "1.5:3", "load threshold (warn above loadt 5 minute load average per CPU)")
+	iowaitt     *string        = flag.String("iowaitt", "20:40", "iowait threshold (warn above iowaitt percent of CPU time)")
+	cpuinterval *time.Duration = flag.Duration("cpuinterval", time.Second, "how long to sample CPU usage for")
+)
+
+func init() {
+	Register("mem", checkmem{})
+	Register("swap", checkswap{})
+	Register("load", checkload{})
+	Register("cpu", checkcpu{})
+}
+
+// readProc returns the contents of a file under -proc.
+func readProc(name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(*procroot, name))
+	return string(b), err
+}
+
+// parseMeminfo reads /proc/meminfo into bytes per field.
+func parseMeminfo(s string) map[string]uint64 {
+	info := map[string]uint64{}
+	for _, line := range strings.Split(s, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(f) > 2 && f[2] == "kB" {
+			v *= 1024
+		}
+		info[strings.TrimSuffix(f[0], ":")] = v
+	}
+	return info
+}
+
+// cpuTimes is the aggregate "cpu" line of /proc/stat, in clock ticks.
+type cpuTimes struct {
+	user, nice, system, idle, iowait, irq, softirq, steal uint64
+}
+
+func (t cpuTimes) total() uint64 {
+	return t.user + t.nice + t.system + t.idle + t.iowait + t.irq + t.softirq + t.steal
+}
+
+// parseStat returns the aggregate CPU times in /proc/stat and how many CPUs
+// there are.
+func parseStat(s string) (t cpuTimes, ncpu int, err error) {
+	found := false
+	for _, line := range strings.Split(s, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || !strings.HasPrefix(f[0], "cpu") {
+			continue
+		}
+		if f[0] != "cpu" {
+			ncpu++
+			continue
+		}
+
+		var v [8]uint64
+		for i := range v {
+			if i+1 < len(f) {
+				v[i], _ = strconv.ParseUint(f[i+1], 10, 64)
+			}
+		}
+		t = cpuTimes{v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7]}
+		found = true
+	}
+	if !found {
+		err = fmt.Errorf("no cpu line in stat")
+	}
+	return
+}
+
+// checkmem looks at how much memory is available to start new programs.
+type checkmem struct{}
+
+func (checkmem) Run() Result {
+	wthresh, cthresh, err := parseThresholds(*memt)
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+	s, err := readProc("meminfo")
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+
+	info := parseMeminfo(s)
+	total := info["MemTotal"]
+	avail, ok := info["MemAvailable"]
+	if !ok {
+		// kernels before 3.14 don't estimate it for us
+		avail = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+	if total == 0 {
+		return Result{Status: UNKNOWN, Message: "no MemTotal in meminfo"}
+	}
+
+	pct := 100.0 / float64(total) * (float64(total) - float64(avail))
+
+	return Result{
+		Status:  level(pct, wthresh, cthresh),
+		Message: fmt.Sprintf("%s of %s memory available", bytesToHuman(avail), bytesToHuman(total)),
+		Metrics: []Metric{
+			{Name: "total", Value: float64(total), Unit: "B"},
+			{Name: "available", Value: float64(avail), Unit: "B"},
+			{Name: "pct", Value: pct, Unit: "%",
+				Label: "mem", Warn: num(wthresh), Crit: num(cthresh), Min: num(0), Max: num(100)},
+		},
+	}
+}
+
+// checkswap looks at how much swap is in use.
+type checkswap struct{}
+
+func (checkswap) Run() Result {
+	wthresh, cthresh, err := parseThresholds(*swapt)
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+	s, err := readProc("meminfo")
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+
+	info := parseMeminfo(s)
+	total, free := info["SwapTotal"], info["SwapFree"]
+	if total == 0 {
+		return Result{Status: OK, Message: "no swap"}
+	}
+
+	used := total - free
+	pct := 100.0 / float64(total) * float64(used)
+
+	return Result{
+		Status:  level(pct, wthresh, cthresh),
+		Message: fmt.Sprintf("%s of %s swap in use", bytesToHuman(used), bytesToHuman(total)),
+		Metrics: []Metric{
+			{Name: "total", Value: float64(total), Unit: "B"},
+			{Name: "used", Value: float64(used), Unit: "B"},
+			{Name: "pct", Value: pct, Unit: "%",
+				Label: "swap", Warn: num(wthresh), Crit: num(cthresh), Min: num(0), Max: num(100)},
+		},
+	}
+}
+
+// checkload looks at the load average relative to the number of CPUs.
+type checkload struct{}
+
+func (checkload) Run() Result {
+	wthresh, cthresh, err := parseThresholds(*loadt)
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+	s, err := readProc("loadavg")
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+	stat, err := readProc("stat")
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+	_, ncpu, err := parseStat(stat)
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+	if ncpu == 0 {
+		ncpu = 1
+	}
+
+	f := strings.Fields(s)
+	if len(f) < 3 {
+		return Result{Status: UNKNOWN, Message: "malformed loadavg"}
+	}
+
+	r := Result{Status: OK}
+	var load [3]float64
+	for i, name := range []string{"load1", "load5", "load15"} {
+		if load[i], err = strconv.ParseFloat(f[i], 64); err != nil {
+			return Result{Status: UNKNOWN, Message: err.Error()}
+		}
+		load[i] /= float64(ncpu)
+
+		m := Metric{Name: name, Value: load[i], Label: name, Min: num(0)}
+		if name == "load5" {
+			m.Warn, m.Crit = num(wthresh), num(cthresh)
+		}
+		r.Metrics = append(r.Metrics, m)
+	}
+	r.Metrics = append(r.Metrics, Metric{Name: "cpus", Value: float64(ncpu)})
+
+	r.Status = level(load[1], wthresh, cthresh)
+	r.Message = fmt.Sprintf("load per CPU %.2f, %.2f, %.2f on %d CPUs", load[0], load[1], load[2], ncpu)
+	return r
+}
+
+// checkcpu samples how CPU time is spent, flagging time lost waiting on IO.
+type checkcpu struct{}
+
+func (checkcpu) Run() Result {
+	wthresh, cthresh, err := parseThresholds(*iowaitt)
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+
+	sample := func() (cpuTimes, error) {
+		s, err := readProc("stat")
+		if err != nil {
+			return cpuTimes{}, err
+		}
+		t, _, err := parseStat(s)
+		return t, err
+	}
+
+	before, err := sample()
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+	time.Sleep(*cpuinterval)
+	after, err := sample()
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+
+	pct := func(a, b uint64) float64 {
+		elapsed := after.total() - before.total()
+		if elapsed == 0 || b < a {
+			return 0
+		}
+		return 100.0 / float64(elapsed) * float64(b-a)
+	}
+
+	user := pct(before.user+before.nice, after.user+after.nice)
+	system := pct(before.system+before.irq+before.softirq, after.system+after.irq+after.softirq)
+	iowait := pct(before.iowait, after.iowait)
+	steal := pct(before.steal, after.steal)
+	idle := pct(before.idle, after.idle)
+
+	return Result{
+		Status:  level(iowait, wthresh, cthresh),
+		Message: fmt.Sprintf("%.1f%% user, %.1f%% system, %.1f%% iowait, %.1f%% idle over %s", user, system, iowait, idle, *cpuinterval),
+		Metrics: []Metric{
+			{Name: "user", Value: user, Unit: "%"},
+			{Name: "system", Value: system, Unit: "%"},
+			{Name: "steal", Value: steal, Unit: "%"},
+			{Name: "idle", Value: idle, Unit: "%"},
+			{Name: "iowait", Value: iowait, Unit: "%",
+				Label: "iowait", Warn: num(wthresh), Crit: num(cthresh), Min: num(0), Max: num(100)},
+		},
+	}
+}
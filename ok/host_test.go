@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// setFlag sets a string flag for the rest of the test.
+func setFlag(t *testing.T, p *string, v string) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// metric is the value of r's metric called name, or NaN.
+func metric(r Result, name string) float64 {
+	for _, m := range r.Metrics {
+		if m.Name == name {
+			return m.Value
+		}
+	}
+	return math.NaN()
+}
+
+func TestParseMeminfo(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/proc/meminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := parseMeminfo(string(b))
+
+	tests := []struct {
+		field string
+		want  uint64
+	}{
+		{"MemTotal", 16000000 * 1024},
+		{"MemAvailable", 2400000 * 1024},
+		{"SwapFree", 1400000 * 1024},
+		{"Active(anon)", 9873116 * 1024},
+		{"VmallocTotal", 34359738367 * 1024},
+		{"HugePages_Surp", 0},
+		{"Hugepagesize", 2048 * 1024},
+	}
+	for _, tt := range tests {
+		if v, ok := info[tt.field]; !ok || v != tt.want {
+			t.Errorf("%s = %d, %t, want %d", tt.field, v, ok, tt.want)
+		}
+	}
+
+	// counts, not sizes, aren't in kB
+	info = parseMeminfo("HugePages_Total:      16\nbogus\nMemFree: lots kB\n\n")
+	if len(info) != 1 || info["HugePages_Total"] != 16 {
+		t.Errorf("got %v, want only HugePages_Total 16", info)
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/proc/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		stat  string
+		times cpuTimes
+		ncpu  int
+		fails bool
+	}{
+		{string(b), cpuTimes{4705, 356, 584, 3699, 23, 23, 0, 0}, 4, false},
+		// 2.4 kernels only had user, nice, system and idle
+		{"cpu 10 20 30 40\ncpu0 10 20 30 40\n", cpuTimes{user: 10, nice: 20, system: 30, idle: 40}, 1, false},
+		{"intr 1\nctxt 2\n", cpuTimes{}, 0, true},
+		{"", cpuTimes{}, 0, true},
+	}
+	for _, tt := range tests {
+		times, ncpu, err := parseStat(tt.stat)
+		if (err != nil) != tt.fails {
+			t.Errorf("%q: err %v", tt.stat, err)
+			continue
+		}
+		if times != tt.times || ncpu != tt.ncpu {
+			t.Errorf("%q: got %+v on %d CPUs, want %+v on %d", tt.stat, times, ncpu, tt.times, tt.ncpu)
+		}
+	}
+
+	if times, _, _ := parseStat(string(b)); times.total() != 9390 {
+		t.Errorf("total %d, want 9390", times.total())
+	}
+}
+
+func TestHostChecks(t *testing.T) {
+	tests := []struct {
+		check   Check
+		proc    string
+		flag    *string
+		thresh  string
+		metric  string
+		value   float64
+		status  Status
+		message string
+	}{
+		// 2400000 of 16000000 kB available
+		{checkmem{}, "testdata/proc", memt, "80:90", "pct", 85, WARN, "2G of 15G memory available"},
+		{checkmem{}, "testdata/proc", memt, "90:95", "pct", 85, OK, ""},
+		{checkmem{}, "testdata/proc", memt, "70:80", "pct", 85, CRIT, ""},
+		// no MemAvailable, so MemFree, Buffers and Cached: 2000000 of 4000000 kB
+		{checkmem{}, "testdata/proc-2.6", memt, "80:90", "pct", 50, OK, "1G of 3G memory available"},
+		{checkmem{}, "testdata/proc-2.6", memt, "40:45", "pct", 50, CRIT, ""},
+
+		// 600000 of 2000000 kB in use
+		{checkswap{}, "testdata/proc", swapt, "50:80", "pct", 30, OK, "585M of 1G swap in use"},
+		{checkswap{}, "testdata/proc", swapt, "20:80", "pct", 30, WARN, ""},
+		{checkswap{}, "testdata/proc", swapt, "10:20", "pct", 30, CRIT, ""},
+		{checkswap{}, "testdata/proc-2.6", swapt, "0:0", "pct", math.NaN(), OK, "no swap"},
+
+		// 4.80 over 4 CPUs
+		{checkload{}, "testdata/proc", loadt, "1.5:3", "load5", 1.2, OK, "load per CPU 1.60, 1.20, 0.80 on 4 CPUs"},
+		{checkload{}, "testdata/proc", loadt, "1:3", "load5", 1.2, WARN, ""},
+		{checkload{}, "testdata/proc", loadt, "0.5:1", "load5", 1.2, CRIT, ""},
+		{checkload{}, "testdata/proc", loadt, "1.5", "load5", math.NaN(), UNKNOWN, ""},
+		{checkload{}, "testdata/proc-2.6", loadt, "1.5:3", "load5", math.NaN(), UNKNOWN, ""},
+	}
+
+	for _, tt := range tests {
+		setFlag(t, procroot, tt.proc)
+		setFlag(t, tt.flag, tt.thresh)
+
+		r := tt.check.Run()
+		name := filepath.Base(tt.proc) + " " + tt.thresh
+		if r.Status != tt.status {
+			t.Errorf("%T %s: %s (%s), want %s", tt.check, name, r.Status, r.Message, tt.status)
+		}
+		if v := metric(r, tt.metric); math.Abs(v-tt.value) > 1e-9 && !(math.IsNaN(v) && math.IsNaN(tt.value)) {
+			t.Errorf("%T %s: %s %g, want %g", tt.check, name, tt.metric, v, tt.value)
+		}
+		if tt.message != "" && r.Message != tt.message {
+			t.Errorf("%T %s: message %q, want %q", tt.check, name, r.Message, tt.message)
+		}
+	}
+}
+
+func TestCheckmemWithoutTotal(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "meminfo"), []byte("MemFree: 100 kB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, procroot, dir)
+
+	if r := (checkmem{}).Run(); r.Status != UNKNOWN {
+		t.Errorf("%s (%s), want UNKNOWN", r.Status, r.Message)
+	}
+}
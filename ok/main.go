@@ -3,7 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
 func bytesToHuman(n uint64) string {
@@ -37,8 +42,105 @@ func warn(a ...interface{}) error {
 	return nil
 }
 
+// formatMetric renders m for people, honouring -H.
+func formatMetric(m Metric) string {
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tags := make([]string, len(keys))
+	for i, k := range keys {
+		tags[i] = m.Tags[k]
+	}
+
+	value := perfValue(m.Value) + m.Unit
+	switch {
+	case m.Unit == "B" && *human:
+		value = bytesToHuman(uint64(m.Value))
+	case m.Unit == "%":
+		value = fmt.Sprintf("%2.2f%%", m.Value)
+	}
+
+	return strings.TrimSpace(strings.Join(tags, " ") + " " + m.Name + " " + value)
+}
+
+// push sends the metrics of every result to b.
+func push(b Backend, names []string, results []Result) error {
+	host := hostname()
+	now := time.Now()
+
+	for i, r := range results {
+		if err := b.Write(points(names[i], host, r, now)...); err != nil {
+			b.Close()
+			return err
+		}
+	}
+	return b.Close()
+}
+
 func main() {
 	flag.Parse()
 
-	checkfs()
+	var names []string
+	err := applyConfig()
+	if err == nil {
+		names, err = selected()
+	}
+	if err == nil && *nagios && *daemon {
+		// a plugin runs once; the daemon alerts through the notifiers
+		err = fmt.Errorf("-nagios and -daemon can't be used together")
+	}
+	if err != nil {
+		if *nagios {
+			fmt.Println("UNKNOWN -", err)
+			os.Exit(int(UNKNOWN))
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	host := hostname()
+
+	var alerts *alerter
+	if !*nagios {
+		if alerts, err = setupAlerts(host); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if *daemon {
+		log.Fatal(runDaemon(names, alerts))
+	}
+
+	results := make([]Result, len(names))
+	for i, name := range names {
+		results[i] = registry[name].Run()
+	}
+
+	if *influxurl != "" {
+		if err := push(NewInfluxBackend(*influxurl, *influxdb), names, results); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	if *nagios {
+		os.Exit(plugin(os.Stdout, names, results))
+	}
+
+	now := time.Now()
+	for i, name := range names {
+		r := results[i]
+
+		if *verbose {
+			fmt.Println(name, r.Status.String()+":", r.Message)
+			for _, m := range r.Metrics {
+				fmt.Println(" ", formatMetric(m))
+			}
+		}
+
+		logAlertError(name, alerts.Check(name, r, now))
+	}
 }
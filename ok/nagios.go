@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	nagios *bool = flag.Bool("nagios", false, "behave as a Nagios/Icinga plugin: one line of output and exit 0/1/2/3")
+)
+
+// pluginStatus is the word plugins use for s.
+func pluginStatus(s Status) string {
+	switch s {
+	case OK:
+		return "OK"
+	case WARN:
+		return "WARNING"
+	case CRIT:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// perfValue formats v to the millisecond or so, without trailing zeros, as
+// plugins do.
+func perfValue(v float64) string {
+	return strconv.FormatFloat(math.Floor(v*1000+0.5)/1000, 'f', -1, 64)
+}
+
+// perfdata renders the labelled metrics in results as plugin perfdata:
+// 'label'=value[unit];[warn];[crit];[min];[max]
+func perfdata(results []Result) string {
+	var perf []string
+
+	opt := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return perfValue(*v)
+	}
+
+	for _, r := range results {
+		for _, m := range r.Metrics {
+			if m.Label == "" {
+				continue
+			}
+			label := m.Label
+			if strings.ContainsAny(label, " '=") {
+				label = "'" + strings.Replace(label, "'", "''", -1) + "'"
+			}
+			p := fmt.Sprintf("%s=%s%s;%s;%s;%s;%s", label, perfValue(m.Value), m.Unit,
+				opt(m.Warn), opt(m.Crit), opt(m.Min), opt(m.Max))
+			perf = append(perf, strings.TrimRight(p, ";"))
+		}
+	}
+
+	return strings.Join(perf, " ")
+}
+
+// plugin writes the one line summary of results for the checks in names and
+// returns the exit status a plugin should have.
+func plugin(w io.Writer, names []string, results []Result) int {
+	worst := OK
+	var msgs []string
+
+	for i, r := range results {
+		worst = worst.Worse(r.Status)
+		msg := names[i] + ": " + r.Message
+		if r.Status != OK {
+			msg = names[i] + " " + pluginStatus(r.Status) + ": " + r.Message
+		}
+		msgs = append(msgs, msg)
+	}
+
+	line := pluginStatus(worst) + " - " + strings.Join(msgs, "; ")
+	if perf := perfdata(results); perf != "" {
+		line += " | " + perf
+	}
+	fmt.Fprintln(w, line)
+
+	return int(worst)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	procs    *string        = flag.String("procs", "", "comma separated processes that must be running, as name[:min[:max]]; min is 1 if not given")
+	tcpaddrs *string        = flag.String("tcp", "", "comma separated host:port addresses that must accept connections")
+	httpurls *string        = flag.String("http", "", "comma separated URLs that must answer with a 2xx status")
+	timeout  *time.Duration = flag.Duration("timeout", 10*time.Second, "how long tcp and http checks wait for an answer")
+	latencyt *string        = flag.String("latencyt", "1:5", "response time threshold for tcp and http checks (warn above latencyt seconds)")
+)
+
+// ProcessConfig describes a process that should be running.
+type ProcessConfig struct {
+	// Name is matched against the process name, as in /proc/*/comm, or
+	// the name of the program it is running.
+	Name string `yaml:"name" toml:"name"`
+
+	// Cmdline, if set, must appear in the process's command line instead.
+	Cmdline string `yaml:"cmdline" toml:"cmdline"`
+
+	// Min and Max bound how many may be running; no Min means 1, so give
+	// 0 for a process that may be absent, and no Max means any number.
+	Min *int `yaml:"min" toml:"min"`
+	Max int  `yaml:"max" toml:"max"`
+}
+
+func (p ProcessConfig) String() string {
+	if p.Cmdline != "" {
+		return p.Cmdline
+	}
+	return p.Name
+}
+
+// HTTPConfig describes a URL that should be answering.
+type HTTPConfig struct {
+	URL string `yaml:"url" toml:"url"`
+
+	// Status is the status code expected; any 2xx will do by default.
+	Status int `yaml:"status" toml:"status"`
+}
+
+// Idler is implemented by checks that may have nothing to look at. They are
+// left out unless asked for by name.
+type Idler interface {
+	Idle() bool
+}
+
+func init() {
+	Register("procs", checkprocs{})
+	Register("tcp", checktcp{})
+	Register("http", checkhttp{})
+}
+
+// splitList splits a comma separated flag, dropping empty entries.
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// processTargets returns the processes from -procs, or the config file.
+func processTargets() ([]ProcessConfig, error) {
+	if *procs == "" {
+		return conf.Processes, nil
+	}
+
+	var ps []ProcessConfig
+	for _, spec := range splitList(*procs) {
+		parts := strings.Split(spec, ":")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("bad process %q, want name[:min[:max]]", spec)
+		}
+		p := ProcessConfig{Name: parts[0]}
+		var err error
+		if len(parts) > 1 && parts[1] != "" {
+			min, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad process %q: %s", spec, err)
+			}
+			p.Min = &min
+		}
+		if len(parts) > 2 {
+			if p.Max, err = strconv.Atoi(parts[2]); err != nil {
+				return nil, fmt.Errorf("bad process %q: %s", spec, err)
+			}
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+func tcpTargets() []string {
+	if *tcpaddrs == "" {
+		return conf.TCP
+	}
+	return splitList(*tcpaddrs)
+}
+
+func httpTargets() []HTTPConfig {
+	if *httpurls == "" {
+		return conf.HTTP
+	}
+	var hs []HTTPConfig
+	for _, u := range splitList(*httpurls) {
+		hs = append(hs, HTTPConfig{URL: u})
+	}
+	return hs
+}
+
+// process is a running process as seen in /proc.
+type process struct {
+	comm    string
+	argv    []string
+	cmdline string
+}
+
+// listProcesses reads every process under -proc.
+func listProcesses() ([]process, error) {
+	dirs, err := ioutil.ReadDir(*procroot)
+	if err != nil {
+		return nil, err
+	}
+
+	self := strconv.Itoa(os.Getpid())
+	var ps []process
+
+	for _, d := range dirs {
+		if _, err := strconv.Atoi(d.Name()); err != nil || d.Name() == self {
+			continue
+		}
+
+		// processes come and go while we look, so errors are expected
+		comm, err := readProc(filepath.Join(d.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		cmdline, _ := readProc(filepath.Join(d.Name(), "cmdline"))
+
+		p := process{comm: strings.TrimSpace(comm)}
+		if cmdline = strings.TrimRight(cmdline, "\x00"); cmdline != "" {
+			p.argv = strings.Split(cmdline, "\x00")
+			p.cmdline = strings.Join(p.argv, " ")
+		}
+		ps = append(ps, p)
+	}
+
+	return ps, nil
+}
+
+// matches reports whether p is an instance of c.
+func (c ProcessConfig) matches(p process) bool {
+	if c.Cmdline != "" {
+		return strings.Contains(p.cmdline, c.Cmdline)
+	}
+	// comm is cut short at 15 bytes
+	if p.comm == c.Name || len(c.Name) > 15 && p.comm == c.Name[:15] {
+		return true
+	}
+	return len(p.argv) > 0 && filepath.Base(p.argv[0]) == c.Name
+}
+
+// checkprocs counts instances of the processes that should be running.
+type checkprocs struct{}
+
+func (checkprocs) Idle() bool {
+	ps, err := processTargets()
+	return err == nil && len(ps) == 0
+}
+
+func (checkprocs) Run() Result {
+	targets, err := processTargets()
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+	running, err := listProcesses()
+	if err != nil {
+		return Result{Status: UNKNOWN, Message: err.Error()}
+	}
+
+	r := Result{Status: OK}
+	var msgs []string
+
+	for _, t := range targets {
+		min := 1
+		if t.Min != nil {
+			min = *t.Min
+		}
+
+		n := 0
+		for _, p := range running {
+			if t.matches(p) {
+				n++
+			}
+		}
+
+		m := Metric{Name: "count", Tags: map[string]string{"process": t.String()}, Value: float64(n),
+			Label: "procs:" + t.String(), Min: num(0)}
+		if t.Max > 0 {
+			m.Max = num(float64(t.Max))
+		}
+		r.Metrics = append(r.Metrics, m)
+
+		switch {
+		case n < min:
+			r.Status = r.Status.Worse(CRIT)
+			msgs = append(msgs, fmt.Sprintf("%d %s running, want at least %d", n, t, min))
+		case t.Max > 0 && n > t.Max:
+			r.Status = r.Status.Worse(WARN)
+			msgs = append(msgs, fmt.Sprintf("%d %s running, want at most %d", n, t, t.Max))
+		default:
+			msgs = append(msgs, fmt.Sprintf("%d %s running", n, t))
+		}
+	}
+
+	r.Message = strings.Join(msgs, ", ")
+	if len(msgs) == 0 {
+		r.Message = "nothing to check"
+	}
+	return r
+}
+
+// grade rates a response time against -latencyt.
+func grade(r *Result, name string, tags map[string]string, elapsed time.Duration) (Status, error) {
+	wthresh, cthresh, err := parseThresholds(*latencyt)
+	if err != nil {
+		return UNKNOWN, err
+	}
+	secs := elapsed.Seconds()
+	r.Metrics = append(r.Metrics, Metric{Name: "time", Tags: tags, Value: secs, Unit: "s",
+		Label: name, Warn: num(wthresh), Crit: num(cthresh), Min: num(0)})
+	return level(secs, wthresh, cthresh), nil
+}
+
+// checktcp connects to ports that should be listening.
+type checktcp struct{}
+
+func (checktcp) Idle() bool {
+	return len(tcpTargets()) == 0
+}
+
+func (checktcp) Run() Result {
+	r := Result{Status: OK}
+	var msgs []string
+
+	for _, addr := range tcpTargets() {
+		tags := map[string]string{"addr": addr}
+
+		start := time.Now()
+		c, err := net.DialTimeout("tcp", addr, *timeout)
+		if err != nil {
+			r.Status = r.Status.Worse(CRIT)
+			msgs = append(msgs, fmt.Sprintf("%s: %s", addr, err))
+			r.Metrics = append(r.Metrics, Metric{Name: "up", Tags: tags, Value: 0})
+			continue
+		}
+		elapsed := time.Since(start)
+		c.Close()
+
+		r.Metrics = append(r.Metrics, Metric{Name: "up", Tags: tags, Value: 1})
+		s, err := grade(&r, "tcp:"+addr, tags, elapsed)
+		if err != nil {
+			return Result{Status: UNKNOWN, Message: err.Error()}
+		}
+		r.Status = r.Status.Worse(s)
+		msgs = append(msgs, fmt.Sprintf("%s answered in %.3fs", addr, elapsed.Seconds()))
+	}
+
+	r.Message = strings.Join(msgs, ", ")
+	if len(msgs) == 0 {
+		r.Message = "nothing to check"
+	}
+	return r
+}
+
+// checkhttp fetches URLs that should be answering.
+type checkhttp struct{}
+
+func (checkhttp) Idle() bool {
+	return len(httpTargets()) == 0
+}
+
+func (checkhttp) Run() Result {
+	r := Result{Status: OK}
+	var msgs []string
+
+	for _, h := range httpTargets() {
+		tags := map[string]string{"url": h.URL}
+
+		client := &http.Client{Timeout: *timeout}
+		if h.Status != 0 {
+			// the status wanted may be a redirect, which the client would
+			// otherwise follow
+			client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		}
+
+		start := time.Now()
+		resp, err := client.Get(h.URL)
+		if err != nil {
+			r.Status = r.Status.Worse(CRIT)
+			msgs = append(msgs, err.Error())
+			r.Metrics = append(r.Metrics, Metric{Name: "up", Tags: tags, Value: 0})
+			continue
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		elapsed := time.Since(start)
+
+		r.Metrics = append(r.Metrics, Metric{Name: "status", Tags: tags, Value: float64(resp.StatusCode)})
+
+		if h.Status != 0 && resp.StatusCode != h.Status || h.Status == 0 && resp.StatusCode/100 != 2 {
+			r.Status = r.Status.Worse(CRIT)
+			r.Metrics = append(r.Metrics, Metric{Name: "up", Tags: tags, Value: 0})
+			msgs = append(msgs, fmt.Sprintf("%s: %s", h.URL, resp.Status))
+			continue
+		}
+
+		r.Metrics = append(r.Metrics, Metric{Name: "up", Tags: tags, Value: 1})
+		s, err := grade(&r, h.URL, tags, elapsed)
+		if err != nil {
+			return Result{Status: UNKNOWN, Message: err.Error()}
+		}
+		r.Status = r.Status.Worse(s)
+		msgs = append(msgs, fmt.Sprintf("%s answered %d in %.3fs", h.URL, resp.StatusCode, elapsed.Seconds()))
+	}
+
+	r.Message = strings.Join(msgs, ", ")
+	if len(msgs) == 0 {
+		r.Message = "nothing to check"
+	}
+	return r
+}
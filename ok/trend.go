@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	historyfile *string        = flag.String("history", "/var/tmp/ok.history", "file recent disk usage is kept in to predict when disks fill up; empty to disable")
+	historylen  *time.Duration = flag.Duration("historylen", 24*time.Hour, "how far back disk usage is used to predict when disks fill up")
+	fillt       *string        = flag.String("fillt", "72:24", "fill time threshold (warn when a disk is predicted to be full in under fillt hours)")
+)
+
+const (
+	// trendSamples is the most samples kept per mount point.
+	trendSamples = 1000
+
+	// a prediction needs at least this much to go on
+	trendMinSamples = 3
+	trendMinSpan    = 10 * time.Minute
+)
+
+// usageSample is how full a filesystem was at some point.
+type usageSample struct {
+	Time  int64  `json:"t"` // unix seconds
+	Used  uint64 `json:"used"`
+	Total uint64 `json:"total"`
+}
+
+// usageHistory is the recent usage of each mount point.
+type usageHistory struct {
+	path    string
+	samples map[string][]usageSample
+}
+
+// loadHistory reads the history at path; a missing file is an empty history.
+func loadHistory(path string) (*usageHistory, error) {
+	h := &usageHistory{path: path, samples: map[string][]usageSample{}}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &h.samples); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return h, nil
+}
+
+// add records a sample for mount point p, forgetting samples older than
+// -historylen.
+func (h *usageHistory) add(p string, now time.Time, used, total uint64) {
+	cutoff := now.Add(-*historylen).Unix()
+
+	var keep []usageSample
+	for _, s := range h.samples[p] {
+		// a resized filesystem makes the old samples meaningless
+		if s.Time >= cutoff && s.Time < now.Unix() && s.Total == total {
+			keep = append(keep, s)
+		}
+	}
+	keep = append(keep, usageSample{Time: now.Unix(), Used: used, Total: total})
+	if len(keep) > trendSamples {
+		keep = keep[len(keep)-trendSamples:]
+	}
+
+	h.samples[p] = keep
+}
+
+// forget drops mount points that weren't seen this time.
+func (h *usageHistory) forget(seen map[string]bool) {
+	for p := range h.samples {
+		if !seen[p] {
+			delete(h.samples, p)
+		}
+	}
+}
+
+func (h *usageHistory) save() error {
+	b, err := json.Marshal(h.samples)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.path, b)
+}
+
+// timeToFull fits a line through the samples for mount point p and returns
+// how long until it reaches the size of the filesystem, and the growth rate
+// in bytes a second. ok is false if there is too little history to say or
+// usage isn't growing.
+func (h *usageHistory) timeToFull(p string) (ttf time.Duration, rate float64, ok bool) {
+	samples := h.samples[p]
+	n := len(samples)
+	if n < trendMinSamples {
+		return 0, 0, false
+	}
+	first, last := samples[0], samples[n-1]
+	if time.Duration(last.Time-first.Time)*time.Second < trendMinSpan {
+		return 0, 0, false
+	}
+
+	// least squares, with time relative to the last sample to keep the
+	// numbers small
+	var sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x := float64(s.Time - last.Time)
+		y := float64(s.Used)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	fn := float64(n)
+	d := fn*sxx - sx*sx
+	if d == 0 {
+		return 0, 0, false
+	}
+	rate = (fn*sxy - sx*sy) / d
+	if rate <= 0 {
+		return 0, rate, false
+	}
+
+	// where the fitted line is now
+	usedNow := (sy - rate*sx) / fn
+	left := float64(last.Total) - usedNow
+	if left < 0 {
+		left = 0
+	}
+
+	secs := left / rate
+	if secs > math.MaxInt64/float64(time.Second) {
+		return 0, rate, false
+	}
+	return time.Duration(secs * float64(time.Second)), rate, true
+}
+
+// writeFileAtomic replaces the file at path with b, so that a reader never
+// sees it half written.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// levelBelow grades value against warn and crit thresholds that it should
+// stay above.
+func levelBelow(value, warn, crit float64) Status {
+	switch {
+	case value < crit:
+		return CRIT
+	case value < warn:
+		return WARN
+	}
+	return OK
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var trendEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// series is n samples of a 10000 byte filesystem every step, the ith using
+// used(i) bytes.
+func series(n int, step time.Duration, used func(i int) uint64) []usageSample {
+	var ss []usageSample
+	for i := 0; i < n; i++ {
+		ss = append(ss, usageSample{Time: trendEpoch.Add(time.Duration(i) * step).Unix(), Used: used(i), Total: 10000})
+	}
+	return ss
+}
+
+func TestTimeToFull(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []usageSample
+		ttf     time.Duration
+		rate    float64
+		ok      bool
+	}{
+		// 100 bytes every 10 minutes, with 8400 to go
+		{"rising", series(7, 10*time.Minute, func(i int) uint64 { return 1000 + 100*uint64(i) }), 14 * time.Hour, 100.0 / 600, true},
+		{"already full", series(4, 10*time.Minute, func(i int) uint64 { return 9900 + 100*uint64(i) }), 0, 100.0 / 600, true},
+		{"flat", series(7, 10*time.Minute, func(int) uint64 { return 5000 }), 0, 0, false},
+		{"falling", series(7, 10*time.Minute, func(i int) uint64 { return 5000 - 100*uint64(i) }), 0, -100.0 / 600, false},
+		{"too few samples", series(trendMinSamples-1, time.Hour, func(i int) uint64 { return 1000 * uint64(i) }), 0, 0, false},
+		{"too short a time", series(5, time.Minute, func(i int) uint64 { return 1000 * uint64(i) }), 0, 0, false},
+		{"no history", nil, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		h := &usageHistory{samples: map[string][]usageSample{"/": tt.samples}}
+		ttf, rate, ok := h.timeToFull("/")
+		if ok != tt.ok || ttf.Round(time.Second) != tt.ttf || !near(rate, tt.rate) {
+			t.Errorf("%s: got %s at %g/s, %t; want %s at %g/s, %t", tt.name, ttf, rate, ok, tt.ttf, tt.rate, tt.ok)
+		}
+	}
+}
+
+// near reports whether a and b are equal but for rounding.
+func near(a, b float64) bool {
+	d := a - b
+	return d < 1e-9 && d > -1e-9
+}
+
+func TestHistoryAdd(t *testing.T) {
+	defer func(old time.Duration) { *historylen = old }(*historylen)
+	*historylen = time.Hour
+
+	at := func(m int) time.Time { return trendEpoch.Add(time.Duration(m) * time.Minute) }
+	times := func(h *usageHistory, p string) []int {
+		var ms []int
+		for _, s := range h.samples[p] {
+			ms = append(ms, int(time.Unix(s.Time, 0).Sub(trendEpoch)/time.Minute))
+		}
+		return ms
+	}
+
+	tests := []struct {
+		name  string
+		adds  []int // minutes after the epoch
+		total func(m int) uint64
+		want  []int
+	}{
+		{"kept", []int{0, 30, 60}, nil, []int{0, 30, 60}},
+		{"aged out", []int{0, 20, 40, 90}, nil, []int{40, 90}},
+		{"all aged out", []int{0, 10, 200}, nil, []int{200}},
+		// the clock going backwards leaves nothing newer than now
+		{"clock went back", []int{30, 40, 35}, nil, []int{30, 35}},
+		{"resized", []int{0, 10, 20, 30}, func(m int) uint64 {
+			if m >= 20 {
+				return 20000
+			}
+			return 10000
+		}, []int{20, 30}},
+	}
+
+	for _, tt := range tests {
+		h := &usageHistory{samples: map[string][]usageSample{}}
+		for _, m := range tt.adds {
+			total := uint64(10000)
+			if tt.total != nil {
+				total = tt.total(m)
+			}
+			h.add("/", at(m), 100, total)
+		}
+		if got := times(h, "/"); !equalInts(got, tt.want) {
+			t.Errorf("%s: kept samples at %v minutes, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// only so many are kept however often it is sampled
+	h := &usageHistory{samples: map[string][]usageSample{}}
+	for i := 0; i < trendSamples+5; i++ {
+		h.add("/", trendEpoch.Add(time.Duration(i)*time.Second), 100, 10000)
+	}
+	if ss := h.samples["/"]; len(ss) != trendSamples || ss[0].Time != trendEpoch.Unix()+5 {
+		t.Errorf("kept %d samples from %d, want %d from %d", len(ss), ss[0].Time, trendSamples, trendEpoch.Unix()+5)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHistoryForgetAndSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.add("/", trendEpoch, 100, 10000)
+	h.add("/mnt/usb", trendEpoch, 100, 10000)
+	h.forget(map[string]bool{"/": true})
+	if err := h.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.samples) != 1 || len(h.samples["/"]) != 1 || h.samples["/"][0] != (usageSample{Time: trendEpoch.Unix(), Used: 100, Total: 10000}) {
+		t.Errorf("loaded %+v, want one sample of /", h.samples)
+	}
+}
+
+func TestLevelBelow(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  Status
+	}{
+		{100, OK},
+		{72, OK},
+		{71.9, WARN},
+		{24, WARN},
+		{23.9, CRIT},
+		{0, CRIT},
+	}
+	for _, tt := range tests {
+		if got := levelBelow(tt.value, 72, 24); got != tt.want {
+			t.Errorf("%g hours: %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// watchBuffer is how many chunks of output an operator may fall behind by
+// before the rest is dropped; the attacker is never kept waiting.
+const watchBuffer = 256
+
+const adminHelp = `commands:
+  list         show the connected clients
+  attach <id>  watch a client's terminals; close the connection to detach
+  kill <id>    hang up on a client
+  quit
+`
+
+// Write shows terminal output to the operators watching the client.
+func (cl *client) Write(p []byte) (int, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if len(cl.watchers) == 0 {
+		return len(p), nil
+	}
+
+	b := append([]byte(nil), p...)
+	for w := range cl.watchers {
+		select {
+		case w <- b:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (cl *client) watch() chan []byte {
+	w := make(chan []byte, watchBuffer)
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.watchers == nil {
+		cl.watchers = map[chan []byte]bool{}
+	}
+	cl.watchers[w] = true
+	return w
+}
+
+func (cl *client) unwatch(w chan []byte) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	delete(cl.watchers, w)
+}
+
+// ServeAdmin listens for the operator on the Unix socket at path. The socket
+// speaks a line based protocol and is meant to be used with e.g.
+// "nc -U" or "socat - UNIX-CONNECT:path".
+func (s *Server) ServeAdmin(path string) error {
+	// a stale socket from an unclean exit would stop us listening
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// the socket is created with the umask, so narrow it rather than chmod
+	// afterwards and leave a moment where anyone could connect. Umask is
+	// process wide, but this runs at startup before anything else is served.
+	old := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.admin = l
+	s.mu.Unlock()
+
+	log.Println("admin console on", path)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleAdmin(c)
+		}
+	}()
+
+	return nil
+}
+
+// handleAdmin runs commands from an operator until they quit.
+func (s *Server) handleAdmin(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+
+		switch cmd := f[0]; {
+		case cmd == "list":
+			s.adminList(c)
+		case cmd == "attach" && len(f) == 2:
+			s.adminAttach(c, r, f[1])
+			return
+		case cmd == "kill" && len(f) == 2:
+			cl := s.findClient(f[1])
+			if cl == nil {
+				fmt.Fprintln(c, "no such client:", f[1])
+				continue
+			}
+			log.Println(cl.addr, "killed by operator")
+			cl.conn.Close()
+			fmt.Fprintln(c, "killed", cl.id)
+		case cmd == "quit" || cmd == "exit":
+			return
+		default:
+			io.WriteString(c, adminHelp)
+		}
+	}
+}
+
+// findClient returns the connected client with the given session ID.
+func (s *Server) findClient(id string) *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cl := range s.clients {
+		if cl.id == id {
+			return cl
+		}
+	}
+	return nil
+}
+
+type adminRow struct {
+	cl   *client
+	user string
+}
+
+type byStart []adminRow
+
+func (r byStart) Len() int           { return len(r) }
+func (r byStart) Less(i, j int) bool { return r[i].cl.start.Before(r[j].cl.start) }
+func (r byStart) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func (s *Server) adminList(w io.Writer) {
+	s.mu.Lock()
+	rows := make(byStart, 0, len(s.clients))
+	for _, cl := range s.clients {
+		rows = append(rows, adminRow{cl, cl.user})
+	}
+	s.mu.Unlock()
+
+	sort.Sort(rows)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tADDR\tUSER\tSTART\tIN\tOUT")
+	for _, r := range rows {
+		user := r.user
+		if user == "" {
+			user = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n", r.cl.id, r.cl.addr, user,
+			r.cl.start.UTC().Format(time.RFC3339),
+			atomic.LoadInt64(&r.cl.in), atomic.LoadInt64(&r.cl.out))
+	}
+	tw.Flush()
+}
+
+// adminAttach streams a client's terminal output to the operator until
+// either of them goes away. Nothing the operator types reaches the client.
+func (s *Server) adminAttach(c net.Conn, r io.Reader, id string) {
+	cl := s.findClient(id)
+	if cl == nil {
+		fmt.Fprintln(c, "no such client:", id)
+		return
+	}
+
+	w := cl.watch()
+	defer cl.unwatch(w)
+
+	fmt.Fprintf(c, "attached to %s (%s), read-only\n", cl.id, cl.addr)
+
+	detached := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(detached)
+	}()
+
+	gone := time.NewTicker(time.Second)
+	defer gone.Stop()
+
+	for {
+		select {
+		case b := <-w:
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		case <-detached:
+			return
+		case <-gone.C:
+			if s.findClient(id) == nil {
+				fmt.Fprintf(c, "\r\n%s disconnected\n", id)
+				return
+			}
+		}
+	}
+}
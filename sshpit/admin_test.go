@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestServeAdminPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin")
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	s := &Server{}
+	if err := s.ServeAdmin(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.admin.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode %o, want 600", perm)
+	}
+	if mask := syscall.Umask(0); mask != 0 {
+		t.Errorf("umask left at %o, want 0", mask)
+	}
+}
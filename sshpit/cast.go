@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes a terminal session to an asciicast v2 file. The header is
+// written lazily so that the dimensions from a pty-req end up in it. All
+// methods are safe to call on a nil Recorder, which records nothing.
+type Recorder struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	start  time.Time
+	header castHeader
+	begun  bool
+}
+
+// NewRecorder creates the cast file at path; it must not already exist.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &Recorder{
+		w:     f,
+		start: now,
+		header: castHeader{
+			Version:   2,
+			Width:     80,
+			Height:    24,
+			Timestamp: now.Unix(),
+			Env:       map[string]string{},
+		},
+	}, nil
+}
+
+// SetTerm records the TERM the client asked for.
+func (r *Recorder) SetTerm(term string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.header.Env["TERM"] = term
+}
+
+// Resize records a window size change; before the first event it simply
+// sets the dimensions in the header.
+func (r *Recorder) Resize(w, h uint32) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.begun {
+		r.header.Width, r.header.Height = w, h
+		return
+	}
+	r.event("r", fmt.Sprintf("%dx%d", w, h))
+}
+
+// Write records p as output sent to the client.
+func (r *Recorder) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("o", string(p))
+	return len(p), nil
+}
+
+// Input returns a writer that records what the client typed.
+func (r *Recorder) Input() io.Writer {
+	return recorderInput{r}
+}
+
+type recorderInput struct{ r *Recorder }
+
+func (ri recorderInput) Write(p []byte) (int, error) {
+	if ri.r == nil {
+		return len(p), nil
+	}
+	ri.r.mu.Lock()
+	defer ri.r.mu.Unlock()
+	ri.r.event("i", string(p))
+	return len(p), nil
+}
+
+// Close flushes the header if nothing was recorded and closes the file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.begin()
+	return r.w.Close()
+}
+
+// begin writes the header once; r.mu must be held.
+func (r *Recorder) begin() {
+	if r.begun {
+		return
+	}
+	r.begun = true
+	b, _ := json.Marshal(r.header)
+	r.w.Write(append(b, '\n'))
+}
+
+// event appends a single [time, code, data] line; r.mu must be held.
+// Errors are ignored so that a full disk never breaks a session.
+func (r *Recorder) event(code, data string) {
+	r.begin()
+	t := time.Since(r.start).Seconds()
+	b, _ := json.Marshal([]interface{}{t, code, data})
+	r.w.Write(append(b, '\n'))
+}
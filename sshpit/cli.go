@@ -4,17 +4,51 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var logfile string
 var addr string
+var castdir string
+var quarantine string
+var fsroot string
+var eventlog string
+var policy string
+var maxsessions int
+var maxperip int
+var handshaketimeout time.Duration
+var idletimeout time.Duration
+var hostkeys string
+var banner string
+var fakeforward bool
+var adminsock string
 
 func init() {
 	flag.StringVar(&addr, "addr", ":22", "The IP address and port to listen to")
 	flag.StringVar(&logfile, "logfile", "-", "The path to the file to be used for logging; the file will be created so it must not exist")
+	flag.StringVar(&castdir, "castdir", "casts", "The directory session recordings (asciicast v2) are written to; empty to disable")
+	flag.StringVar(&quarantine, "quarantine", "quarantine", "The directory files uploaded over scp and sftp are saved to, named by SHA-256; empty to disable")
+	flag.StringVar(&eventlog, "events", "-", "The path to append the JSON lines event log to; - for stdout")
+	flag.StringVar(&policy, "policy", "", "A JSON file describing which credentials to accept; by default root is let in with any password")
+	flag.IntVar(&maxsessions, "maxsessions", 256, "The maximum number of concurrent connections; 0 for no limit")
+	flag.IntVar(&maxperip, "maxperip", 8, "The maximum number of concurrent connections from one IP address; 0 for no limit")
+	flag.DurationVar(&handshaketimeout, "handshaketimeout", 30*time.Second, "How long a client has to connect and log in")
+	flag.DurationVar(&idletimeout, "idletimeout", 15*time.Minute, "How long a client may stay silent before being disconnected")
+	flag.StringVar(&hostkeys, "hostkeys", "hostkeys", "The directory holding the host keys; missing ed25519, ecdsa and rsa keys are generated")
+	flag.StringVar(&banner, "banner", DefaultServerVersion, "The SSH version string to present to clients")
+	flag.BoolVar(&fakeforward, "fakeforward", false, "Answer port forwarding attempts with a canned banner instead of refusing them; nothing is ever forwarded")
+	flag.StringVar(&adminsock, "admin", "sshpit.sock", "The Unix socket the operator console listens on (try nc -U); empty to disable")
+	flag.StringVar(&fsroot, "fs", "", "A directory or tarball (.tar, .tar.gz) to seed the fake filesystem from; a minimal one is built in")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		report(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	if logfile != "-" {
@@ -26,6 +60,75 @@ func main() {
 		log.SetOutput(f)
 	}
 
+	for _, dir := range []string{castdir, quarantine} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			panic(err)
+		}
+	}
+
 	s := NewServer()
-	s.ListenAndServe(addr)
+	s.ServerVersion = banner
+	s.CastDir = castdir
+	s.QuarantineDir = quarantine
+	s.FakeForward = fakeforward
+	s.MaxSessions = maxsessions
+	s.MaxPerIP = maxperip
+	s.HandshakeTimeout = handshaketimeout
+	s.IdleTimeout = idletimeout
+	s.AdminSocket = adminsock
+
+	if eventlog == "-" {
+		s.Events = NewEventLog(os.Stdout)
+	} else {
+		f, err := os.OpenFile(eventlog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			panic(err)
+		}
+		s.Events = NewEventLog(f)
+	}
+
+	if err := s.LoadHostKeys(hostkeys); err != nil {
+		panic(err)
+	}
+
+	if policy != "" {
+		p, err := LoadPolicy(policy)
+		if err != nil {
+			panic(err)
+		}
+		s.Policy = p
+	}
+
+	if fsroot != "" {
+		fs, err := LoadVFS(fsroot)
+		if err != nil {
+			panic(err)
+		}
+		s.FS = fs
+	}
+
+	if s.AdminSocket != "" {
+		if err := s.ServeAdmin(s.AdminSocket); err != nil {
+			panic(err)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		log.Println("caught", <-sig, "shutting down...")
+
+		s.Shutdown()
+		s.Events.Close()
+		close(done)
+	}()
+
+	if err := s.ListenAndServe(addr); err != nil {
+		log.Fatalln(err)
+	}
+	<-done
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types written to the event log.
+const (
+	EventConnect       = "connect"
+	EventClientVersion = "client_version"
+	EventKex           = "kex"
+	EventAuth          = "auth"
+	EventChannel       = "channel"
+	EventRequest       = "request"
+	EventCommand       = "command"
+	EventDownload      = "download"
+	EventUpload        = "upload"
+	EventForward       = "forward"
+	EventDisconnect    = "disconnect"
+)
+
+// Event is a single honeypot interaction. Every event from one connection
+// carries the same Session so they can be tied back together.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Session string    `json:"session"`
+	Src     string    `json:"src"`
+
+	Version     string   `json:"version,omitempty"`
+	Kex         *KexInit `json:"kex,omitempty"`
+	Method      string   `json:"method,omitempty"`
+	User        string   `json:"user,omitempty"`
+	Password    string   `json:"password,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Accepted    *bool    `json:"accepted,omitempty"` // set on events that decide it
+	Channel     string   `json:"channel,omitempty"`
+	Request     string   `json:"request,omitempty"`
+	Payload     string   `json:"payload,omitempty"`
+	Command     string   `json:"command,omitempty"`
+	Host        string   `json:"host,omitempty"`
+	Port        uint32   `json:"port,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	File        string   `json:"file,omitempty"`
+	SHA256      string   `json:"sha256,omitempty"`
+	Size        int64    `json:"size,omitempty"`
+	Duration    float64  `json:"duration,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// accepted is an Event's Accepted, which is nil where it doesn't apply.
+func accepted(ok bool) *bool {
+	return &ok
+}
+
+// EventLog writes events as JSON lines. A nil EventLog discards everything.
+type EventLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewEventLog returns an EventLog writing to w.
+func NewEventLog(w io.Writer) *EventLog {
+	return &EventLog{w: w, enc: json.NewEncoder(w)}
+}
+
+// Close syncs and closes the underlying file, if there is one.
+func (l *EventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f, ok := l.w.(*os.File); ok && f != os.Stdout {
+		f.Sync()
+		return f.Close()
+	}
+	return nil
+}
+
+// Log stamps e with the current time and writes it.
+func (l *EventLog) Log(e Event) {
+	if l == nil {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.enc.Encode(e); err != nil {
+		log.Println("could not write event:", err)
+	}
+}
+
+// newSessionID returns a random identifier for a connection.
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
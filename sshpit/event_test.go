@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEventAccepted(t *testing.T) {
+	tests := []struct {
+		e    Event
+		want string
+	}{
+		{Event{Type: EventAuth, Accepted: accepted(false)}, `"accepted":false`},
+		{Event{Type: EventAuth, Accepted: accepted(true)}, `"accepted":true`},
+		{Event{Type: EventCommand, Command: "id"}, ""},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		NewEventLog(&b).Log(tt.e)
+		got := b.String()
+		if tt.want == "" && strings.Contains(got, "accepted") || !strings.Contains(got, tt.want) {
+			t.Errorf("%s event logged as %s, want %s", tt.e.Type, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// forwardCapture bounds how much a client may send to a fake endpoint.
+	forwardCapture = 4096
+	forwardTimeout = 10 * time.Second
+)
+
+// fakeHTTP is served to anything that asks a web port for something.
+const fakeHTTP = "<html><head><title>Welcome to nginx!</title></head><body><h1>Welcome to nginx!</h1></body></html>\n"
+
+// fakeService returns the greeting sent as soon as a fake endpoint for port is
+// opened and the reply sent once the client has said something.
+func (s *Server) fakeService(port uint32) (greeting, reply string) {
+	switch port {
+	case 21:
+		return "220 (vsFTPd 3.0.2)\r\n", "530 Please login with USER and PASS.\r\n"
+	case 22:
+		return s.ServerVersion + "\r\n", ""
+	case 25, 587:
+		return "220 " + fakeHostname + " ESMTP Postfix (Ubuntu)\r\n", "250 " + fakeHostname + "\r\n"
+	case 110:
+		return "+OK Dovecot ready.\r\n", "-ERR Unknown command.\r\n"
+	case 143:
+		return "* OK [CAPABILITY IMAP4rev1 LITERAL+ SASL-IR LOGIN-REFERRALS ID ENABLE IDLE STARTTLS AUTH=PLAIN] Dovecot ready.\r\n", ""
+	case 80, 3128, 8000, 8080, 8888:
+		return "", fmt.Sprintf("HTTP/1.1 200 OK\r\nServer: nginx/1.4.6 (Ubuntu)\r\nContent-Type: text/html\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(fakeHTTP), fakeHTTP)
+	}
+	return "", ""
+}
+
+// handleGlobalRequests records connection-level requests, in particular
+// attempts to have us listen for remote port forwarding.
+func (s *Server) handleGlobalRequests(cl *client, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward", "cancel-tcpip-forward":
+			var fwd struct {
+				Host string
+				Port uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &fwd); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			log.Printf("%s %s request for %s:%d", cl.addr, req.Type, fwd.Host, fwd.Port)
+			s.emit(cl.addr, Event{Type: EventForward, Request: req.Type, Host: fwd.Host, Port: fwd.Port, Accepted: accepted(s.FakeForward)})
+
+			// pretend to listen; a real port is never opened
+			var reply []byte
+			if req.Type == "tcpip-forward" && fwd.Port == 0 {
+				reply = ssh.Marshal(struct{ Port uint32 }{uint32(32768 + rand.Intn(28232))})
+			}
+			req.Reply(s.FakeForward, reply)
+		default:
+			log.Println(cl.addr, "global request:", req.Type)
+			s.emit(cl.addr, Event{Type: EventRequest, Request: req.Type, Payload: string(req.Payload)})
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// handleDirectTCPIP records a client's attempt to use us as a proxy. Nothing
+// is ever forwarded: the channel is refused or, with FakeForward, answered by
+// a canned imitation of the service on the target port.
+func (s *Server) handleDirectTCPIP(cl *client, nc ssh.NewChannel) {
+	var fwd struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &fwd); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "bad request")
+		return
+	}
+
+	log.Printf("%s direct-tcpip request for %s:%d", cl.addr, fwd.Host, fwd.Port)
+	e := Event{Type: EventForward, Channel: nc.ChannelType(), Host: fwd.Host, Port: fwd.Port, Accepted: accepted(s.FakeForward)}
+
+	if !s.FakeForward {
+		s.emit(cl.addr, e)
+		nc.Reject(ssh.Prohibited, "administratively prohibited: open failed")
+		return
+	}
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		e.Error = err.Error()
+		s.emit(cl.addr, e)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	greeting, reply := s.fakeService(fwd.Port)
+	io.WriteString(ch, greeting)
+
+	data := readQuiet(ch, forwardCapture, forwardTimeout)
+	e.Payload = string(data)
+	s.emit(cl.addr, e)
+
+	if len(data) > 0 {
+		io.WriteString(ch, reply)
+	}
+}
+
+// readQuiet collects what the client sends until it has sent limit bytes,
+// goes quiet for a moment after sending something, or timeout passes.
+func readQuiet(r io.Reader, limit int, timeout time.Duration) []byte {
+	chunks := make(chan []byte)
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 1024)
+			n, err := r.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- buf[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var data []byte
+	deadline := time.After(timeout)
+
+	for len(data) < limit {
+		var quiet <-chan time.Time
+		if len(data) > 0 {
+			quiet = time.After(500 * time.Millisecond)
+		}
+
+		select {
+		case c, ok := <-chunks:
+			if !ok {
+				return data
+			}
+			data = append(data, c...)
+		case <-quiet:
+			return data
+		case <-deadline:
+			return data
+		}
+	}
+
+	if len(data) > limit {
+		data = data[:limit]
+	}
+	return data
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeys are the keys a stock OpenSSH install generates, by file name.
+var hostKeys = []struct {
+	file     string
+	generate func() (*pem.Block, error)
+}{
+	{"ssh_host_ed25519_key", func() (*pem.Block, error) {
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalPKCS8PrivateKey(k)
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: b}, err
+	}},
+	{"ssh_host_ecdsa_key", func() (*pem.Block, error) {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalECPrivateKey(k)
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, err
+	}},
+	{"ssh_host_rsa_key", func() (*pem.Block, error) {
+		k, err := rsa.GenerateKey(rand.Reader, 3072)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	}},
+}
+
+// LoadHostKeys adds the ed25519, ecdsa and rsa host keys in dir to s,
+// generating and saving any that are missing so the honeypot keeps the same
+// identity across restarts.
+func (s *Server) LoadHostKeys(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	for _, hk := range hostKeys {
+		path := filepath.Join(dir, hk.file)
+
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			log.Println("generating host key", path)
+			if b, err = generateHostKey(path, hk.generate); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("host key %s %s", signer.PublicKey().Type(), fingerprint(signer.PublicKey()))
+		s.AddHostKey(signer)
+	}
+
+	return nil
+}
+
+// generateHostKey writes a new private key to path and its public half
+// alongside it, returning the private key PEM.
+func generateHostKey(path string, generate func() (*pem.Block, error)) ([]byte, error) {
+	block, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	b := pem.EncodeToMemory(block)
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, ioutil.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+}
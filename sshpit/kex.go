@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+const msgKexInit = 20
+
+// KexInit holds the algorithm lists a client offered in its SSH_MSG_KEXINIT,
+// which are a good fingerprint of the client software.
+type KexInit struct {
+	Kex         []string `json:"kex"`
+	HostKey     []string `json:"host_key"`
+	Ciphers     []string `json:"ciphers"`
+	MACs        []string `json:"macs"`
+	Compression []string `json:"compression"`
+}
+
+// kexSniffer watches the start of an incoming connection for the client's
+// identification line and KEXINIT, both of which are sent in the clear.
+type kexSniffer struct {
+	net.Conn
+
+	buf     []byte
+	version bool
+	done    bool
+
+	// Version and Kex are called once each when found.
+	Version func(string)
+	Kex     func(*KexInit)
+}
+
+func (k *kexSniffer) Read(p []byte) (int, error) {
+	n, err := k.Conn.Read(p)
+
+	if !k.done && n > 0 {
+		k.buf = append(k.buf, p[:n]...)
+		k.sniff()
+	}
+
+	return n, err
+}
+
+func (k *kexSniffer) sniff() {
+	// give up on anything that isn't SSH
+	if len(k.buf) > 64*1024 {
+		k.done, k.buf = true, nil
+		return
+	}
+
+	if !k.version {
+		i := bytes.IndexByte(k.buf, '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimRight(string(k.buf[:i]), "\r")
+		k.buf = k.buf[i+1:]
+
+		// RFC 4253 allows other lines before the identification
+		if !strings.HasPrefix(line, "SSH-") {
+			k.sniff()
+			return
+		}
+		k.version = true
+		if k.Version != nil {
+			k.Version(line)
+		}
+	}
+
+	if len(k.buf) < 5 {
+		return
+	}
+	length := binary.BigEndian.Uint32(k.buf)
+	if length > 35000 {
+		k.done, k.buf = true, nil
+		return
+	}
+	if uint32(len(k.buf)-4) < length {
+		return
+	}
+
+	padding := uint32(k.buf[4])
+	if padding+1 <= length {
+		if kex := parseKexInit(k.buf[5 : 4+length-padding]); kex != nil && k.Kex != nil {
+			k.Kex(kex)
+		}
+	}
+	k.done, k.buf = true, nil
+}
+
+// parseKexInit decodes a KEXINIT payload, returning nil if it isn't one.
+func parseKexInit(b []byte) *KexInit {
+	if len(b) < 17 || b[0] != msgKexInit {
+		return nil
+	}
+	b = b[17:] // message type and cookie
+
+	var lists [10][]string
+	for i := range lists {
+		if len(b) < 4 {
+			return nil
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return nil
+		}
+		if n > 0 {
+			lists[i] = strings.Split(string(b[4:4+n]), ",")
+		}
+		b = b[4+n:]
+	}
+
+	// the client to server and server to client lists are almost always the
+	// same, so only the former is kept
+	return &KexInit{
+		Kex:         lists[0],
+		HostKey:     lists[1],
+		Ciphers:     lists[2],
+		MACs:        lists[4],
+		Compression: lists[6],
+	}
+}
@@ -1,26 +1,20 @@
 package main
 
 import (
-	"bufio"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"os/exec"
-	"strings"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/kr/pty"
 
-	"code.google.com/p/go.crypto/ssh"
+	"golang.org/x/crypto/ssh"
 )
 
-func copyAndClose(r io.ReadCloser, w io.WriteCloser) error {
-	io.Copy(w, r)
-	once.Do(close)
-}
-
 func rejectOrAccept(c ssh.NewChannel) (ssh.Channel, <-chan *ssh.Request, error) {
 	// Channels have a type, depending on the application level
 	// protocol intended. In the case of a shell, the type is
@@ -28,120 +22,216 @@ func rejectOrAccept(c ssh.NewChannel) (ssh.Channel, <-chan *ssh.Request, error)
 	// terminal interface.
 	if c.ChannelType() != "session" {
 		c.Reject(ssh.UnknownChannelType, "unknown channel type: "+c.ChannelType())
-		return
+		return nil, nil, fmt.Errorf("rejected channel type %s", c.ChannelType())
 	}
 
-	channel, in, err := c.Accept()
+	return c.Accept()
+}
 
+func (s *Server) Serve(c net.Conn) error {
+	cl, err := s.register(c)
 	if err != nil {
-		return nil, nil, err
+		s.Events.Log(Event{Type: EventConnect, Session: cl.id, Src: cl.addr.String(), Error: err.Error()})
+		c.Close()
+		return err
 	}
+	defer s.unregister(cl)
 
-	return channel, in, err
-}
-
-type NewChannelHandler struct {
-	SessionHandler func(ssh.Channel, <-chan *ssh.Request, error)
-}
+	s.emit(cl.addr, Event{Type: EventConnect})
 
-func (s *Server) Serve(c net.Conn) error {
-	var err error
+	tc := &timeoutConn{Conn: &countConn{Conn: c, cl: cl}}
+	if s.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
 
 	// Before use, a handshake must be performed on the incoming
 	// net.Conn.
-	_, chans, reqs, err := ssh.NewServerConn(c, &s.ServerConfig)
+	sniffer := &kexSniffer{
+		Conn: tc,
+		Version: func(v string) {
+			s.emit(cl.addr, Event{Type: EventClientVersion, Version: v})
+		},
+		Kex: func(k *KexInit) {
+			s.emit(cl.addr, Event{Type: EventKex, Kex: k})
+		},
+	}
+	sc, chans, reqs, err := ssh.NewServerConn(sniffer, &s.ServerConfig)
 
 	if err != nil {
+		s.emit(cl.addr, Event{Type: EventDisconnect, Duration: time.Since(cl.start).Seconds(), Error: err.Error()})
+		c.Close()
 		return err
 	}
 
-	select {
-	case req := <-reqs:
-		log.Println(req)
-	case c := <-chans:
-		if ch, reqs, err := rejectOrAccept(c); err == nil {
+	c.SetDeadline(time.Time{})
+	tc.setIdle(s.IdleTimeout)
 
-		}
-	}
+	s.mu.Lock()
+	cl.user = sc.User()
+	s.mu.Unlock()
 
-	// Service the incoming Channel channel.
-	for newChannel := range chans {
-		channel, requests, err := rejectOrAccept(newChannel)
+	defer func() {
+		s.emit(cl.addr, Event{Type: EventDisconnect, Duration: time.Since(cl.start).Seconds()})
+	}()
+
+	go s.handleGlobalRequests(cl, reqs)
 
-		// allocate a terminal for this channel
-		log.Print("creating pty...")
+	// Every channel on this connection shares one filesystem so that what
+	// is dropped by one can be found by the next.
+	fs := s.FS.Clone()
 
-		f, tty, err := pty.Open()
+	// Service the incoming Channel channel.
+	n := 0
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go s.handleDirectTCPIP(cl, newChannel)
+			continue
+		}
 
+		channel, requests, err := rejectOrAccept(newChannel)
+		s.emit(cl.addr, Event{Type: EventChannel, Channel: newChannel.ChannelType(), Accepted: accepted(err == nil)})
 		if err != nil {
-			log.Printf("could not start pty (%s)", err)
+			log.Println(c.RemoteAddr(), err)
 			continue
 		}
 
-		f.Write([]byte("this is cool"))
+		n++
+		// added here, while Serve is itself counted, so that Shutdown
+		// can't finish waiting before the session has started
+		s.wg.Add(1)
+		go s.handleSession(cl, sc, fs, n, channel, requests)
+	}
 
-		//teardown session
-		var once sync.Once
-		close := func() {
-			channel.Close()
+	return nil
+}
 
-			log.Printf("session closed")
-		}
+// castPath returns the file a session channel is recorded to. The session ID
+// keeps apart connections from one address in the same second.
+func (s *Server) castPath(cl *client, n int) string {
+	name := fmt.Sprintf("%s-%s-%s-%d.cast", time.Now().UTC().Format("20060102T150405Z"), cl.ip, cl.id, n)
+	return filepath.Join(s.CastDir, name)
+}
 
-		log.Println("OK now")
+// session is a single accepted "session" channel and its fake terminal.
+type session struct {
+	server  *Server
+	client  *client
+	conn    ssh.ConnMetadata
+	channel ssh.Channel
+	pty     *os.File
+	tty     *os.File
+	rec     *Recorder
+	shell   *Shell
+	started bool
+	once    sync.Once
+}
 
-		copyAndClose(channel, f)
-		copyAndClose(f, channel)
+// handleSession serves a session channel, which has been added to s.wg and
+// is marked done there once it is closed.
+func (s *Server) handleSession(cl *client, c *ssh.ServerConn, fs *VFS, n int, channel ssh.Channel, requests <-chan *ssh.Request) {
+	// allocate a terminal for this channel
+	log.Print("creating pty...")
 
-		//pipe session to bash and visa-versa
-		go func() {
-			log.Println("starting S->C")
-			tr := io.TeeReader(channel, f)
-			br := bufio.NewReader(tr)
-			var e error
-			var line []byte
+	f, tty, err := pty.Open()
 
-			for e != io.EOF {
-				line, _, e = br.ReadLine()
-				log.Printf("%s server replied: %s", c.RemoteAddr(), string(line))
-			}
+	if err != nil {
+		log.Printf("could not start pty (%s)", err)
+		channel.Close()
+		s.wg.Done()
+		return
+	}
 
-			b, err := ioutil.ReadAll(br)
-			if err != nil {
-				log.Println("err:", err)
-			}
-			log.Printf("%s server replied: %s", c.RemoteAddr(), string(b))
-
-			once.Do(close)
-		}()
-		go func() {
-			log.Println("starting C->S")
-			tr := io.TeeReader(f, channel)
-			br := bufio.NewReader(tr)
-			line, _, e := br.ReadLine()
-			if e != nil {
-				log.Println(e)
-			}
-			log.Printf("%s client: %s\n", c.RemoteAddr(), string(line))
-			ioutil.ReadAll(br)
-			once.Do(close)
-		}()
+	ss := &session{
+		server:  s,
+		client:  cl,
+		conn:    c,
+		channel: channel,
+		pty:     f,
+		tty:     tty,
+		shell:   NewShell(fs, c.User()),
+	}
 
-		go handleSSHRequests(f, c, requests)
+	ss.shell.Command = func(line string) {
+		s.emit(c.RemoteAddr(), Event{Type: EventCommand, Command: line})
+	}
+	ss.shell.Capture = func(u string) {
+		log.Println(c.RemoteAddr(), "captured download", u)
+		s.emit(c.RemoteAddr(), Event{Type: EventDownload, URL: u})
 	}
 
-	return nil
+	if s.CastDir != "" {
+		if ss.rec, err = NewRecorder(s.castPath(cl, n)); err != nil {
+			log.Printf("could not record session (%s)", err)
+		}
+	}
+
+	go func() {
+		c.Wait()
+		ss.close()
+	}()
+
+	ss.handleRequests(requests)
+
+	// the client has closed the channel
+	ss.close()
+}
+
+// close tears down the session; it is safe to call more than once.
+func (ss *session) close() {
+	ss.once.Do(func() {
+		defer ss.server.wg.Done()
+
+		ss.channel.Close()
+		ss.pty.Close()
+		ss.tty.Close()
+		ss.rec.Close()
+
+		log.Printf("%s session closed", ss.conn.RemoteAddr())
+	})
 }
 
-func handleSSHRequests(f *os.File, c net.Conn, in <-chan *ssh.Request) {
+// attach pipes the channel to the pty and visa-versa, recording both
+// directions and showing the output to any operator watching. The client closing its end is passed on as ^D and the session
+// ends when the shell hangs up the terminal.
+func (ss *session) attach() {
+	go func() {
+		io.Copy(ss.pty, io.TeeReader(ss.channel, ss.rec.Input()))
+		ss.pty.Write([]byte{4})
+	}()
+	go func() {
+		io.Copy(io.MultiWriter(ss.channel, ss.rec, ss.client), ss.pty)
+		ss.close()
+	}()
+}
+
+// exit reports status to the client and hangs up the terminal; the session
+// is torn down once the pty has drained.
+func (ss *session) exit(status int) {
+	ss.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	ss.tty.Close()
+}
+
+// raw runs fn directly on the channel, bypassing the terminal, for binary
+// protocols such as scp and sftp.
+func (ss *session) raw(fn func(rw io.ReadWriter) int) {
+	status := fn(ss.channel)
+	ss.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	ss.close()
+}
+
+func (ss *session) handleRequests(in <-chan *ssh.Request) {
+	c := ss.conn
+
 	for req := range in {
+		ss.server.emit(c.RemoteAddr(), Event{Type: EventRequest, Request: req.Type, Payload: requestPayload(req)})
+
 		ok := false
 		switch req.Type {
 		case "env":
 			ok = true
 			log.Println(c.RemoteAddr(), string(req.Payload))
 		case "shell":
-			ok = true
+			ok = !ss.started
 			if len(req.Payload) > 0 {
 				log.Println(c.RemoteAddr(), "PAYLOAD", string(req.Payload))
 				// We don't accept any
@@ -149,10 +239,43 @@ func handleSSHRequests(f *os.File, c net.Conn, in <-chan *ssh.Request) {
 				// default shell.
 				ok = false
 			}
+			if ok {
+				ss.started = true
+				ss.attach()
+				go func() {
+					ss.exit(ss.shell.Run(ss.tty))
+				}()
+			}
 		case "exec":
-			log.Println(c.RemoteAddr(), "exec request:", string(req.Payload))
-			ok = true
-			fakeShellCommand(f, string(req.Payload))
+			cmd := parseString(req.Payload)
+			log.Println(c.RemoteAddr(), "exec request:", cmd)
+			ok = !ss.started
+			if !ok {
+				break
+			}
+			ss.started = true
+
+			if target, sink := scpTarget(cmd); sink {
+				ss.shell.Command(cmd)
+				go ss.raw(func(rw io.ReadWriter) int {
+					return ss.scpSink(rw, target)
+				})
+				break
+			}
+
+			ss.attach()
+			go func() {
+				status, _ := ss.shell.Exec(ss.tty, cmd)
+				ss.exit(status)
+			}()
+		case "subsystem":
+			name := parseString(req.Payload)
+			log.Println(c.RemoteAddr(), "subsystem request:", name)
+			ok = !ss.started && name == "sftp"
+			if ok {
+				ss.started = true
+				go ss.raw(ss.sftp)
+			}
 		case "pty-req":
 			// Responding 'ok' here will let the client
 			// know we have a pty ready for input
@@ -161,11 +284,14 @@ func handleSSHRequests(f *os.File, c net.Conn, in <-chan *ssh.Request) {
 			termLen := req.Payload[3]
 			termEnv := string(req.Payload[4 : termLen+4])
 			w, h := parseDims(req.Payload[termLen+4:])
-			SetWinsize(f.Fd(), w, h)
+			SetWinsize(ss.pty.Fd(), w, h)
+			ss.rec.SetTerm(termEnv)
+			ss.rec.Resize(w, h)
 			log.Printf("pty-req '%s'", termEnv)
 		case "window-change":
 			w, h := parseDims(req.Payload)
-			SetWinsize(f.Fd(), w, h)
+			SetWinsize(ss.pty.Fd(), w, h)
+			ss.rec.Resize(w, h)
 			continue //no response
 
 		default:
@@ -178,50 +304,48 @@ func handleSSHRequests(f *os.File, c net.Conn, in <-chan *ssh.Request) {
 	}
 }
 
-var pass = map[string]func(s string) string{
-	"uname": func(s string) (r string) {
-		r = strings.Replace(s, "helium", "everbor", -1)
-		if rp := strings.Split(r, " "); len(rp) > 2 {
-			rp[2] = "2.6.1-64-generic"
-			r = strings.Join(rp, " ")
-		}
-		return r
-	},
-	"echo": func(s string) string {
-		return s
-	},
+// requestPayload renders a channel request's payload for the event log.
+func requestPayload(req *ssh.Request) string {
+	switch req.Type {
+	case "env":
+		name := parseString(req.Payload)
+		return name + "=" + parseString(req.Payload[4+len(name):])
+	case "exec", "subsystem", "pty-req":
+		return parseString(req.Payload)
+	}
+	return string(req.Payload)
 }
 
-func fakeShellCommand(f *os.File, cmd string) {
-	log.Println(cmd)
-	cmdparts := strings.Split(cmd, " ")
-
-	log.Printf("cmd (%s)\n", cmdparts[0])
+func (s *Server) passwordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	ok := s.Policy.Password(c.RemoteAddr(), c.User(), string(pass))
+	s.emit(c.RemoteAddr(), Event{Type: EventAuth, Method: "password", User: c.User(), Password: string(pass), Accepted: accepted(ok)})
 
-	if fn, ok := pass[cmdparts[0]]; ok {
-		c := exec.Command(cmdparts[0], cmdparts[1:]...)
-		b, _ := c.CombinedOutput()
-		s := fn(string(b))
-		s = strings.Replace(s, "\n", "\r\n", -1)
-		sb := []byte(s)
-		f.Write(sb)
-	} else {
-		f.Write([]byte("I'm sorry, I can't do that (" + strings.Join(cmdparts, ", ") + ")right now.\r\n"))
+	if ok {
+		log.Printf("%s login successful for %s with pass '%s'\n", c.RemoteAddr(), c.User(), string(pass))
+		return nil, nil
 	}
+	return nil, fmt.Errorf("password rejected for %q '%s'", c.User(), string(pass))
 }
 
-func passwordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-	if c.User() == "root" {
-	 	log.Printf("%s login successful for %s with pass '%s'\n", c.RemoteAddr(), c.User(), string(pass))
-	 	return nil, nil
-	}
-	return nil, fmt.Errorf("password rejected for %q '%s'", c.User(), string(pass))
+func (s *Server) publicKeyCallback(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	fp := fingerprint(key)
+	ok := s.Policy.PublicKey(c.User(), fp)
+	s.emit(c.RemoteAddr(), Event{Type: EventAuth, Method: "publickey", User: c.User(), Fingerprint: fp, Accepted: accepted(ok)})
 
-	log.Printf("%s login successful for %s with pass '%s'\n", c.RemoteAddr(), c.User(), string(pass))
-	return nil, nil
+	if ok {
+		log.Printf("%s login successful for %s with %s key %s\n", c.RemoteAddr(), c.User(), key.Type(), fp)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s key rejected for %q %s", key.Type(), c.User(), fp)
 }
 
-func authLogCallback(conn ssh.ConnMetadata, method string, err error) {
+func (s *Server) authLogCallback(conn ssh.ConnMetadata, method string, err error) {
+	// passwords and keys are logged along with the credential by their own
+	// callbacks
+	if method != "password" && method != "publickey" {
+		s.emit(conn.RemoteAddr(), Event{Type: EventAuth, Method: method, User: conn.User(), Accepted: accepted(err == nil)})
+	}
+
 	if err == nil || method == "none" {
 		return
 	}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Credential is an entry in a policy's allow list. Empty fields match
+// anything, so {"user": "root"} accepts root with any password.
+type Credential struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+
+	// Key is a public key fingerprint as logged (SHA256:...).
+	Key string `json:"key"`
+}
+
+// failureWindow is how long a source address's failed logins count towards
+// AcceptAfter. Addresses that don't try again within it are forgotten, so a
+// scan from many addresses doesn't grow the table forever.
+const failureWindow = time.Hour
+
+// failures counts an address's failed logins.
+type failures struct {
+	n    int
+	last time.Time
+}
+
+// Policy decides which logins the honeypot accepts, allowing different
+// deception profiles to be run from a file, e.g.
+//
+//	{"allow": [{"user": "root", "password": "admin"}], "accept_after": 3}
+type Policy struct {
+	// Allow lists credentials that are always accepted.
+	Allow []Credential `json:"allow"`
+
+	// AcceptAfter accepts any password once a source address has failed
+	// this many times; 0 disables it.
+	AcceptAfter int `json:"accept_after"`
+
+	// Probability accepts any password with this chance (0 to 1).
+	Probability float64 `json:"probability"`
+
+	// AcceptKeys accepts every public key offered.
+	AcceptKeys bool `json:"accept_keys"`
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	now      func() time.Time
+	failures map[string]failures
+	swept    time.Time // when stale failures were last dropped
+}
+
+// DefaultPolicy accepts any password for root and nothing else.
+func DefaultPolicy() *Policy {
+	return newPolicy(&Policy{Allow: []Credential{{User: "root"}}})
+}
+
+// LoadPolicy reads a JSON policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	if err = json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+
+	return newPolicy(p), nil
+}
+
+func newPolicy(p *Policy) *Policy {
+	p.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	p.now = time.Now
+	p.failures = map[string]failures{}
+	return p
+}
+
+func (p *Policy) allowed(user, pass, key string) bool {
+	for _, c := range p.Allow {
+		if c.User != "" && c.User != user {
+			continue
+		}
+		if key != "" {
+			if c.Key == key {
+				return true
+			}
+			continue
+		}
+		if c.Key == "" && (c.Password == "" || c.Password == pass) {
+			return true
+		}
+	}
+	return false
+}
+
+// Password reports whether user may log in with pass from addr.
+func (p *Policy) Password(addr net.Addr, user, pass string) bool {
+	ip, _, _ := net.SplitHostPort(addr.String())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if now.Sub(p.swept) >= failureWindow {
+		for a, f := range p.failures {
+			if now.Sub(f.last) >= failureWindow {
+				delete(p.failures, a)
+			}
+		}
+		p.swept = now
+	}
+
+	f := p.failures[ip]
+	if now.Sub(f.last) >= failureWindow {
+		f = failures{}
+	}
+
+	ok := p.allowed(user, pass, "") ||
+		(p.AcceptAfter > 0 && f.n >= p.AcceptAfter) ||
+		(p.Probability > 0 && p.rand.Float64() < p.Probability)
+
+	switch {
+	case ok:
+		delete(p.failures, ip)
+	case p.AcceptAfter > 0:
+		p.failures[ip] = failures{n: f.n + 1, last: now}
+	}
+
+	return ok
+}
+
+// PublicKey reports whether user may log in with the key with fingerprint.
+func (p *Policy) PublicKey(user, fingerprint string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.AcceptKeys || p.allowed(user, "", fingerprint)
+}
+
+// fingerprint returns the OpenSSH style SHA256 fingerprint of key.
+func fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPolicyAcceptAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := newPolicy(&Policy{AcceptAfter: 3})
+	p.now = func() time.Time { return now }
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+
+	tests := []struct {
+		minutes int
+		want    bool
+	}{
+		{0, false},
+		{1, false},
+		{2, false},
+		{3, true},
+		// accepting starts the count again
+		{4, false},
+		{5, false},
+		// and failures too old don't count
+		{70, false},
+		{71, false},
+		{72, false},
+		{73, true},
+	}
+	start := now
+	for _, tt := range tests {
+		now = start.Add(time.Duration(tt.minutes) * time.Minute)
+		if got := p.Password(addr, "admin", "x"); got != tt.want {
+			t.Errorf("%dm: accepted %t, want %t", tt.minutes, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyForgetsFailures(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := newPolicy(&Policy{AcceptAfter: 3})
+	p.now = func() time.Time { return now }
+
+	// a scan from many addresses
+	for i := 0; i < 1000; i++ {
+		p.Password(&net.TCPAddr{IP: net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/256, i%256)), Port: 22}, "admin", "x")
+	}
+	if len(p.failures) != 1000 {
+		t.Fatalf("%d addresses remembered, want 1000", len(p.failures))
+	}
+
+	now = now.Add(failureWindow)
+	p.Password(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}, "admin", "x")
+	if len(p.failures) != 1 {
+		t.Errorf("%d addresses remembered after the window, want 1", len(p.failures))
+	}
+
+	// without AcceptAfter there is nothing to count
+	p = newPolicy(&Policy{})
+	p.Password(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}, "admin", "x")
+	if len(p.failures) != 0 {
+		t.Errorf("%d addresses remembered without accept_after", len(p.failures))
+	}
+}
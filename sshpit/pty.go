@@ -14,6 +14,18 @@ func parseDims(b []byte) (uint32, uint32) {
 	return w, h
 }
 
+// parseString extracts an SSH wire-format string from the provided buffer.
+func parseString(b []byte) string {
+	if len(b) < 4 {
+		return ""
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		n = uint32(len(b) - 4)
+	}
+	return string(b[4 : 4+n])
+}
+
 // Winsize stores the Height and Width of a terminal.
 type Winsize struct {
 	Height uint16
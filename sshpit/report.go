@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Stats summarises an event log.
+type Stats struct {
+	Events      int
+	Sessions    int
+	Users       counter
+	Passwords   counter
+	IPs         counter
+	Commands    counter
+	Versions    counter
+	Credentials counter // "user:password" pairs
+	PerHour     map[time.Time]int
+}
+
+// counter tallies how often each value was seen.
+type counter map[string]int
+
+type count struct {
+	Value string
+	N     int
+}
+
+// Top returns the n most frequent values, most frequent first; n <= 0 returns
+// all of them.
+func (c counter) Top(n int) []count {
+	cs := make([]count, 0, len(c))
+	for v, k := range c {
+		cs = append(cs, count{v, k})
+	}
+	sort.Sort(byCount(cs))
+	if n > 0 && len(cs) > n {
+		cs = cs[:n]
+	}
+	return cs
+}
+
+type byCount []count
+
+func (c byCount) Len() int      { return len(c) }
+func (c byCount) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCount) Less(i, j int) bool {
+	if c[i].N != c[j].N {
+		return c[i].N > c[j].N
+	}
+	return c[i].Value < c[j].Value
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		Users:       counter{},
+		Passwords:   counter{},
+		IPs:         counter{},
+		Commands:    counter{},
+		Versions:    counter{},
+		Credentials: counter{},
+		PerHour:     map[time.Time]int{},
+	}
+}
+
+// Add accounts for a single event.
+func (st *Stats) Add(e *Event) {
+	st.Events++
+
+	switch e.Type {
+	case EventConnect:
+		if e.Error != "" {
+			break
+		}
+		st.Sessions++
+		ip, _, err := net.SplitHostPort(e.Src)
+		if err != nil {
+			ip = e.Src
+		}
+		st.IPs[ip]++
+		st.PerHour[e.Time.UTC().Truncate(time.Hour)]++
+	case EventClientVersion:
+		st.Versions[e.Version]++
+	case EventAuth:
+		if e.User == "" || e.Method == "none" {
+			break
+		}
+		st.Users[e.User]++
+		if e.Method == "password" {
+			st.Passwords[e.Password]++
+			st.Credentials[e.User+":"+e.Password]++
+		}
+	case EventCommand:
+		st.Commands[e.Command]++
+	}
+}
+
+// Read adds every event in r. Lines that aren't events, such as ordinary log
+// output sharing the same file, are skipped.
+func (st *Stats) Read(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxUpload)
+
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil || e.Type == "" {
+			continue
+		}
+		st.Add(&e)
+	}
+	return sc.Err()
+}
+
+// ReadFile adds the events in the log at path, which may be gzipped; "-"
+// reads stdin.
+func (st *Stats) ReadFile(path string) error {
+	if path == "-" {
+		return st.Read(os.Stdin)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return st.Read(r)
+}
+
+// WriteReport prints the summary, listing at most top entries per table.
+func (st *Stats) WriteReport(w io.Writer, top int) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "%d events, %d sessions from %d addresses, %d unique credentials\n",
+		st.Events, st.Sessions, len(st.IPs), len(st.Credentials))
+
+	tables := []struct {
+		title string
+		c     counter
+	}{
+		{"usernames", st.Users},
+		{"passwords", st.Passwords},
+		{"credentials", st.Credentials},
+		{"source addresses", st.IPs},
+		{"commands", st.Commands},
+		{"client versions", st.Versions},
+	}
+	for _, t := range tables {
+		fmt.Fprintf(tw, "\ntop %s (%d unique)\n", t.title, len(t.c))
+		for _, c := range t.c.Top(top) {
+			fmt.Fprintf(tw, "%d\t%q\n", c.N, c.Value)
+		}
+	}
+
+	fmt.Fprintln(tw, "\nsessions per hour (UTC)")
+	hours := make([]time.Time, 0, len(st.PerHour))
+	max := 0
+	for h, n := range st.PerHour {
+		hours = append(hours, h)
+		if n > max {
+			max = n
+		}
+	}
+	sort.Sort(byTime(hours))
+	for _, h := range hours {
+		n := st.PerHour[h]
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", h.Format("2006-01-02 15:00"), n, strings.Repeat("#", (n*40+max-1)/max))
+	}
+
+	tw.Flush()
+}
+
+type byTime []time.Time
+
+func (t byTime) Len() int           { return len(t) }
+func (t byTime) Less(i, j int) bool { return t[i].Before(t[j]) }
+func (t byTime) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// report implements "sshpit report [flags] [eventlog ...]".
+func report(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	top := fs.Int("top", 10, "How many entries to show per table; 0 for all")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sshpit report [flags] [eventlog ...]")
+		fmt.Fprintln(os.Stderr, "Summarises JSON event logs (gzipped or not); stdin is read if none are given.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	st := NewStats()
+	for _, f := range files {
+		if err := st.ReadFile(f); err != nil {
+			fmt.Fprintln(os.Stderr, "sshpit report:", err)
+			os.Exit(1)
+		}
+	}
+
+	st.WriteReport(os.Stdout, *top)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// scpTarget returns the destination of an "scp -t" (sink mode) command line,
+// which is what the remote end runs when a file is copied to us.
+func scpTarget(cmd string) (string, bool) {
+	toks := tokenize(cmd)
+	if len(toks) < 2 || path.Base(toks[0].s) != "scp" {
+		return "", false
+	}
+
+	sink := false
+	target := "."
+	for _, t := range toks[1:] {
+		switch {
+		case t.op:
+			return "", false
+		case t.s == "--":
+		case strings.HasPrefix(t.s, "-"):
+			sink = sink || strings.Contains(t.s, "t")
+		default:
+			target = t.s
+		}
+	}
+
+	return target, sink
+}
+
+// maxSCPLine is the longest control line, e.g. "C0644 12 name", accepted.
+const maxSCPLine = 4096
+
+// scpSink speaks the receiving side of the rcp/scp protocol on rw, storing
+// every file sent. It returns the exit status for the scp command.
+func (ss *session) scpSink(rw io.ReadWriter, target string) int {
+	br := bufio.NewReaderSize(rw, maxSCPLine)
+	ack := func() { rw.Write([]byte{0}) }
+	fail := func(format string, a ...interface{}) int {
+		fmt.Fprintf(rw, "\x02scp: "+format+"\n", a...)
+		return 1
+	}
+
+	dirs := []string{ss.shell.abs(target)}
+	ack()
+
+	for {
+		// a line that doesn't fit in the buffer is too long
+		b, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return fail("protocol error: line too long")
+		}
+		if err != nil {
+			return 0
+		}
+		line := strings.TrimSuffix(string(b), "\n")
+		if line == "" {
+			continue
+		}
+
+		switch line[0] {
+		case 'C', 'D':
+			// C0644 12 name or D0755 0 name
+			parts := strings.SplitN(line[1:], " ", 3)
+			if len(parts) != 3 {
+				return fail("protocol error: %s", line)
+			}
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || size < 0 {
+				return fail("protocol error: bad size %q", parts[1])
+			}
+			name := path.Base(parts[2])
+
+			dir := dirs[len(dirs)-1]
+			dest := dir
+			if n, err := ss.shell.fs.Stat(dir); err == nil && n.children != nil {
+				dest = path.Join(dir, name)
+			}
+
+			if line[0] == 'D' {
+				ss.shell.fs.MkdirAll(dest)
+				dirs = append(dirs, dest)
+				ack()
+				continue
+			}
+
+			if size > maxUpload {
+				return fail("%s: No space left on device", name)
+			}
+			ack()
+
+			data := make([]byte, size)
+			if _, err = io.ReadFull(br, data); err != nil {
+				return 1
+			}
+			// the sender follows the data with a status byte
+			if _, err = br.ReadByte(); err != nil {
+				return 1
+			}
+
+			ss.upload("scp", dest, data)
+			ack()
+		case 'E':
+			if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			ack()
+		case 'T':
+			ack()
+		case 1, 2:
+			// warning or error from the sender
+		default:
+			return fail("protocol error: %q", line)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// scpConn feeds an scp sink what a sender would and keeps its replies.
+type scpConn struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *scpConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c *scpConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+
+func TestScpSink(t *testing.T) {
+	long := "C0644 4 " + strings.Repeat("a", maxSCPLine) + "\n"
+
+	tests := []struct {
+		input  string
+		status int
+		file   string // where the upload ends up, if anywhere
+		reply  string
+	}{
+		{"C0644 4 f\nabcd\x00", 0, "/tmp/f", "\x00\x00\x00"},
+		{"D0755 0 d\nC0644 4 f\nabcd\x00E\n", 0, "/tmp/d/f", "\x00\x00\x00\x00\x00"},
+		{"C0644 x f\n", 1, "", "\x00\x02scp: protocol error: bad size \"x\"\n"},
+		{long, 1, "", "\x00\x02scp: protocol error: line too long\n"},
+	}
+
+	for _, tt := range tests {
+		ss := &session{server: &Server{}, conn: fakeConn{}, shell: NewShell(NewVFS().Clone(), "root")}
+		c := &scpConn{in: strings.NewReader(tt.input)}
+
+		if status := ss.scpSink(c, "/tmp"); status != tt.status {
+			t.Errorf("%.20q: status %d, want %d", tt.input, status, tt.status)
+		}
+		if c.out.String() != tt.reply {
+			t.Errorf("%.20q: replied %q, want %q", tt.input, c.out.String(), tt.reply)
+		}
+		if tt.file != "" {
+			if b, err := ss.shell.fs.ReadFile(tt.file); err != nil || string(b) != "abcd" {
+				t.Errorf("%.20q: %s is %q, %v", tt.input, tt.file, b, err)
+			}
+		}
+	}
+}
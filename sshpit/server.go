@@ -1,40 +1,189 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
+	"errors"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"code.google.com/p/go.crypto/ssh"
+	"golang.org/x/crypto/ssh"
 )
 
+// DefaultServerVersion is the banner of a stock Ubuntu 14.04 sshd, to match
+// the fake filesystem.
+const DefaultServerVersion = "SSH-2.0-OpenSSH_6.6.1p1 Ubuntu-2ubuntu2"
+
 type Server struct {
 	ssh.ServerConfig
+
+	// CastDir is where session recordings are written; empty disables them.
+	CastDir string
+
+	// QuarantineDir is where files uploaded by clients are kept, named by
+	// their SHA-256; empty disables it.
+	QuarantineDir string
+
+	// FS is the filesystem each connection starts with a private copy of.
+	FS *VFS
+
+	// Policy decides which credentials are accepted.
+	Policy *Policy
+
+	// Events receives a structured record of everything clients do.
+	Events *EventLog
+
+	// FakeForward accepts port forwarding requests and answers direct-tcpip
+	// channels with a canned banner instead of refusing them. Nothing is
+	// ever actually forwarded.
+	FakeForward bool
+
+	// MaxSessions caps concurrent connections overall and MaxPerIP caps
+	// them per source address; zero means no limit.
+	MaxSessions int
+	MaxPerIP    int
+
+	// HandshakeTimeout bounds the time from connecting to being logged in
+	// and IdleTimeout hangs up on clients that go quiet; zero disables.
+	HandshakeTimeout time.Duration
+	IdleTimeout      time.Duration
+
+	// AdminSocket is the Unix socket the operator console listens on;
+	// empty disables it.
+	AdminSocket string
+
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	listener net.Listener
+	admin    net.Listener
+	closing  bool
+	clients  map[string]*client
+	perIP    map[string]int
 }
 
-func NewServer() *Server {
-	s := &Server{}
+// client is a single connection to the honeypot.
+type client struct {
+	id    string
+	addr  net.Addr
+	ip    string
+	start time.Time
+	conn  net.Conn
+	user  string // set once logged in, under Server.mu
 
-	s.PasswordCallback = passwordCallback
-	s.AuthLogCallback = authLogCallback
+	in, out int64 // bytes received and sent, accessed atomically
 
-	privateBytes, err := ioutil.ReadFile("/root/.ssh/id_rsa")
-	if err != nil {
-		panic("Failed to load private key")
+	// watchers are operators attached to the client's terminals
+	mu       sync.Mutex
+	watchers map[chan []byte]bool
+}
+
+var (
+	errTooManySessions = errors.New("too many sessions")
+	errTooManyForIP    = errors.New("too many sessions from this address")
+	errShuttingDown    = errors.New("shutting down")
+)
+
+// timeoutConn hangs up once a client hasn't sent anything for idle.
+type timeoutConn struct {
+	net.Conn
+	idle int64 // time.Duration, accessed atomically
+}
+
+func (c *timeoutConn) setIdle(d time.Duration) {
+	atomic.StoreInt64(&c.idle, int64(d))
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if d := time.Duration(atomic.LoadInt64(&c.idle)); d > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(d))
 	}
+	return c.Conn.Read(p)
+}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		panic("Failed to parse private key")
+// countConn tallies the traffic of a client's connection.
+type countConn struct {
+	net.Conn
+	cl *client
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.cl.in, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.cl.out, int64(n))
+	return n, err
+}
+
+func NewServer() *Server {
+	s := &Server{
+		FS:      NewVFS(),
+		Policy:  DefaultPolicy(),
+		clients: map[string]*client{},
+		perIP:   map[string]int{},
 	}
 
-	s.AddHostKey(private)
+	s.PasswordCallback = s.passwordCallback
+	s.PublicKeyCallback = s.publicKeyCallback
+	s.AuthLogCallback = s.authLogCallback
+	s.ServerVersion = DefaultServerVersion
 
 	return s
 }
 
-func (s *Server) ListenAndServe(addr string) {
+// register starts tracking a new connection under a fresh session ID. The
+// client is returned even if the connection is over one of the limits.
+func (s *Server) register(c net.Conn) (*client, error) {
+	cl := &client{id: newSessionID(), addr: c.RemoteAddr(), start: time.Now(), conn: c}
+	cl.ip, _, _ = net.SplitHostPort(cl.addr.String())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.closing:
+		return cl, errShuttingDown
+	case s.MaxSessions > 0 && len(s.clients) >= s.MaxSessions:
+		return cl, errTooManySessions
+	case s.MaxPerIP > 0 && s.perIP[cl.ip] >= s.MaxPerIP:
+		return cl, errTooManyForIP
+	}
+
+	s.clients[cl.addr.String()] = cl
+	s.perIP[cl.ip]++
+
+	return cl, nil
+}
+
+func (s *Server) unregister(cl *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.clients, cl.addr.String())
+	if s.perIP[cl.ip]--; s.perIP[cl.ip] <= 0 {
+		delete(s.perIP, cl.ip)
+	}
+}
+
+// emit logs e against the connection from addr.
+func (s *Server) emit(addr net.Addr, e Event) {
+	s.mu.Lock()
+	cl := s.clients[addr.String()]
+	s.mu.Unlock()
+
+	if cl != nil {
+		e.Session = cl.id
+	}
+	e.Src = addr.String()
+
+	s.Events.Log(e)
+}
+
+func (s *Server) ListenAndServe(addr string) error {
 	if addr == "" {
 		addr = ":22"
 	}
@@ -43,21 +192,59 @@ func (s *Server) ListenAndServe(addr string) {
 		panic("failed to listen for connection")
 	}
 	log.Println("listening on", listener.Addr())
-	s.Listen(listener)
+	return s.Listen(listener)
 }
 
+// Listen serves every connection accepted from l in its own goroutine. It
+// returns nil once Shutdown has been called.
 func (s *Server) Listen(l net.Listener) error {
-	var c net.Conn
-	var err error
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
 
 	for {
-		if c, err = l.Accept(); err != nil {
-			fmt.Errorf("err: %s", err)
-			continue
-		}
-		if err = s.Serve(c); err != nil {
-			fmt.Errorf("err: %s", err)
-			continue
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+
+			if closing {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("err:", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
 		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.Serve(c); err != nil {
+				log.Println(c.RemoteAddr(), "err:", err)
+			}
+		}()
 	}
 }
+
+// Shutdown stops accepting connections, hangs up on every client and waits
+// for their sessions to be torn down.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	for _, cl := range s.clients {
+		cl.conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+)
+
+// SFTP version 3 packet types, see draft-ietf-secsh-filexfer-02.
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpFstat    = 8
+	sshFxpSetstat  = 9
+	sshFxpFsetstat = 10
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpMkdir    = 14
+	sshFxpRmdir    = 15
+	sshFxpRealpath = 16
+	sshFxpStat     = 17
+	sshFxpRename   = 18
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+
+	sshFxOk               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxBadMessage       = 5
+	sshFxOpUnsupported    = 8
+
+	sshFxfWrite = 0x02
+
+	sshFileXferAttrSize        = 0x01
+	sshFileXferAttrUIDGID      = 0x02
+	sshFileXferAttrPermissions = 0x04
+	sshFileXferAttrACModTime   = 0x08
+	sshFileXferAttrExtended    = 0x80000000
+)
+
+// Limits on what one sftp session holds in memory at once.
+const (
+	maxSftpHandles  = 64
+	maxSftpBuffered = maxUpload // bytes written to files not yet closed
+)
+
+var errBadMessage = errors.New("bad message")
+
+// sftpBuffer decodes the fields of an incoming SFTP packet.
+type sftpBuffer struct {
+	b   []byte
+	err error
+}
+
+func (r *sftpBuffer) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpBuffer) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+func (r *sftpBuffer) bytes() []byte {
+	n := r.uint32()
+	if uint64(n) > uint64(len(r.b)) {
+		r.err = errBadMessage
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sftpBuffer) string() string {
+	return string(r.bytes())
+}
+
+// attrs skips over a file attributes structure.
+func (r *sftpBuffer) attrs() {
+	flags := r.uint32()
+	if flags&sshFileXferAttrSize != 0 {
+		r.uint64()
+	}
+	if flags&sshFileXferAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sshFileXferAttrPermissions != 0 {
+		r.uint32()
+	}
+	if flags&sshFileXferAttrACModTime != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sshFileXferAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+}
+
+// sftpPacket builds an outgoing SFTP packet.
+type sftpPacket struct {
+	bytes.Buffer
+}
+
+func newSftpPacket(typ byte, id uint32) *sftpPacket {
+	p := &sftpPacket{}
+	p.WriteByte(typ)
+	p.uint32(id)
+	return p
+}
+
+func (p *sftpPacket) uint32(v uint32) {
+	binary.Write(p, binary.BigEndian, v)
+}
+
+func (p *sftpPacket) string(s string) {
+	p.uint32(uint32(len(s)))
+	p.WriteString(s)
+}
+
+func (p *sftpPacket) attrs(n *vnode) {
+	mode := uint32(n.mode.Perm())
+	if n.children != nil {
+		mode |= 0040000
+	} else {
+		mode |= 0100000
+	}
+	t := uint32(n.modTime.Unix())
+
+	p.uint32(sshFileXferAttrSize | sshFileXferAttrUIDGID | sshFileXferAttrPermissions | sshFileXferAttrACModTime)
+	binary.Write(p, binary.BigEndian, uint64(len(n.data)))
+	p.uint32(0)
+	p.uint32(0)
+	p.uint32(mode)
+	p.uint32(t)
+	p.uint32(t)
+}
+
+// sftpHandle is an open file or directory.
+type sftpHandle struct {
+	path    string
+	write   bool
+	data    []byte
+	entries []*vnode // directory listing not yet returned
+	listed  bool
+}
+
+// sftpServer is a minimal SFTP server over a session's fake filesystem. Files
+// written to it are uploaded to quarantine when they are closed.
+type sftpServer struct {
+	ss       *session
+	rw       io.ReadWriter
+	handles  map[string]*sftpHandle
+	next     int
+	buffered uint64 // bytes held by write handles
+}
+
+// sftp serves the sftp subsystem on rw until the client goes away.
+func (ss *session) sftp(rw io.ReadWriter) int {
+	s := &sftpServer{ss: ss, rw: rw, handles: map[string]*sftpHandle{}}
+
+	for {
+		var length uint32
+		if err := binary.Read(rw, binary.BigEndian, &length); err != nil {
+			break
+		}
+		if length == 0 || length > maxUpload {
+			return 1
+		}
+
+		b := make([]byte, length)
+		if _, err := io.ReadFull(rw, b); err != nil {
+			break
+		}
+
+		if err := s.handle(b[0], &sftpBuffer{b: b[1:]}); err != nil {
+			return 1
+		}
+	}
+
+	// anything still open when the client hangs up is kept too
+	for _, h := range s.handles {
+		s.closeHandle(h)
+	}
+	return 0
+}
+
+func (s *sftpServer) send(p *sftpPacket) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(p.Len()))
+	_, err := s.rw.Write(append(length[:], p.Bytes()...))
+	return err
+}
+
+func (s *sftpServer) status(id, code uint32, msg string) error {
+	p := newSftpPacket(sshFxpStatus, id)
+	p.uint32(code)
+	p.string(msg)
+	p.string("")
+	return s.send(p)
+}
+
+// errStatus maps a VFS error onto an SFTP status.
+func (s *sftpServer) errStatus(id uint32, err error) error {
+	switch err {
+	case nil:
+		return s.status(id, sshFxOk, "Success")
+	case errNotExist:
+		return s.status(id, sshFxNoSuchFile, "No such file")
+	case errIsDir, errNotDir:
+		return s.status(id, sshFxFailure, err.Error())
+	}
+	return s.status(id, sshFxFailure, "Failure")
+}
+
+// newHandle opens h, unless too many handles are open already.
+func (s *sftpServer) newHandle(h *sftpHandle) (string, bool) {
+	if len(s.handles) >= maxSftpHandles {
+		return "", false
+	}
+	s.next++
+	name := strconv.Itoa(s.next)
+	s.handles[name] = h
+	return name, true
+}
+
+func (s *sftpServer) closeHandle(h *sftpHandle) {
+	if h.write {
+		s.buffered -= uint64(len(h.data))
+		s.ss.upload("sftp", h.path, h.data)
+	}
+}
+
+func (s *sftpServer) handle(typ byte, r *sftpBuffer) error {
+	if typ == sshFxpInit {
+		p := &sftpPacket{}
+		p.WriteByte(sshFxpVersion)
+		p.uint32(3)
+		return s.send(p)
+	}
+
+	id := r.uint32()
+	fs := s.ss.shell.fs
+
+	switch typ {
+	case sshFxpRealpath:
+		p := s.ss.shell.abs(r.string())
+		pkt := newSftpPacket(sshFxpName, id)
+		pkt.uint32(1)
+		pkt.string(p)
+		pkt.string(p)
+		pkt.uint32(0)
+		return s.send(pkt)
+
+	case sshFxpStat, sshFxpLstat:
+		n, err := fs.Stat(s.ss.shell.abs(r.string()))
+		if err != nil {
+			return s.errStatus(id, err)
+		}
+		pkt := newSftpPacket(sshFxpAttrs, id)
+		pkt.attrs(n)
+		return s.send(pkt)
+
+	case sshFxpFstat:
+		h, ok := s.handles[r.string()]
+		if !ok {
+			return s.status(id, sshFxFailure, "invalid handle")
+		}
+		n := &vnode{name: path.Base(h.path), mode: 0644, data: h.data}
+		if !h.write {
+			if vn, err := fs.Stat(h.path); err == nil {
+				n = vn
+			}
+		}
+		pkt := newSftpPacket(sshFxpAttrs, id)
+		pkt.attrs(n)
+		return s.send(pkt)
+
+	case sshFxpOpen:
+		p := s.ss.shell.abs(r.string())
+		flags := r.uint32()
+		r.attrs()
+
+		h := &sftpHandle{path: p, write: flags&sshFxfWrite != 0}
+		if !h.write {
+			data, err := fs.ReadFile(p)
+			if err != nil {
+				return s.errStatus(id, err)
+			}
+			h.data = data
+		} else if dir, err := fs.Stat(path.Dir(p)); err != nil || dir.children == nil {
+			return s.status(id, sshFxNoSuchFile, "No such file")
+		}
+
+		name, ok := s.newHandle(h)
+		if !ok {
+			return s.status(id, sshFxFailure, "Too many open files")
+		}
+		pkt := newSftpPacket(sshFxpHandle, id)
+		pkt.string(name)
+		return s.send(pkt)
+
+	case sshFxpOpendir:
+		p := s.ss.shell.abs(r.string())
+		entries, err := fs.ReadDir(p)
+		if err != nil {
+			return s.errStatus(id, err)
+		}
+		name, ok := s.newHandle(&sftpHandle{path: p, entries: entries})
+		if !ok {
+			return s.status(id, sshFxFailure, "Too many open files")
+		}
+		pkt := newSftpPacket(sshFxpHandle, id)
+		pkt.string(name)
+		return s.send(pkt)
+
+	case sshFxpReaddir:
+		h, ok := s.handles[r.string()]
+		if !ok {
+			return s.status(id, sshFxFailure, "invalid handle")
+		}
+		if h.listed {
+			return s.status(id, sshFxEOF, "EOF")
+		}
+		h.listed = true
+
+		pkt := newSftpPacket(sshFxpName, id)
+		pkt.uint32(uint32(len(h.entries)))
+		for _, e := range h.entries {
+			pkt.string(e.name)
+			pkt.string(fmt.Sprintf("%s 1 %-8s %-8s %8d %s %s", e.mode, s.ss.shell.user, s.ss.shell.user, len(e.data), e.modTime.Format("Jan _2 15:04"), e.name))
+			pkt.attrs(e)
+		}
+		return s.send(pkt)
+
+	case sshFxpRead:
+		h, ok := s.handles[r.string()]
+		offset := r.uint64()
+		length := r.uint32()
+		if !ok {
+			return s.status(id, sshFxFailure, "invalid handle")
+		}
+		if offset >= uint64(len(h.data)) {
+			return s.status(id, sshFxEOF, "EOF")
+		}
+		end := offset + uint64(length)
+		if end > uint64(len(h.data)) {
+			end = uint64(len(h.data))
+		}
+		pkt := newSftpPacket(sshFxpData, id)
+		pkt.string(string(h.data[offset:end]))
+		return s.send(pkt)
+
+	case sshFxpWrite:
+		h, ok := s.handles[r.string()]
+		offset := r.uint64()
+		data := r.bytes()
+		if !ok || !h.write {
+			return s.status(id, sshFxFailure, "invalid handle")
+		}
+		// checked before adding them up, which a huge offset would overflow
+		if offset > maxUpload || uint64(len(data)) > maxUpload-offset {
+			return s.status(id, sshFxFailure, "No space left on device")
+		}
+		end := offset + uint64(len(data))
+		if end > uint64(len(h.data)) {
+			grow := end - uint64(len(h.data))
+			// all the files being written share one budget
+			if s.buffered+grow > maxSftpBuffered {
+				return s.status(id, sshFxFailure, "No space left on device")
+			}
+			s.buffered += grow
+			h.data = append(h.data, make([]byte, grow)...)
+		}
+		copy(h.data[offset:], data)
+		return s.status(id, sshFxOk, "Success")
+
+	case sshFxpClose:
+		name := r.string()
+		h, ok := s.handles[name]
+		if !ok {
+			return s.status(id, sshFxFailure, "invalid handle")
+		}
+		delete(s.handles, name)
+		s.closeHandle(h)
+		return s.status(id, sshFxOk, "Success")
+
+	case sshFxpMkdir:
+		return s.errStatus(id, fs.MkdirAll(s.ss.shell.abs(r.string())))
+
+	case sshFxpSetstat, sshFxpFsetstat, sshFxpRemove, sshFxpRmdir, sshFxpRename:
+		// pretend these worked; nothing of interest is lost
+		return s.status(id, sshFxOk, "Success")
+	}
+
+	if r.err != nil {
+		return s.status(id, sshFxBadMessage, "bad message")
+	}
+	return s.status(id, sshFxOpUnsupported, "Operation unsupported")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpWrite is the body of an SSH_FXP_WRITE packet, after its type.
+func sftpWrite(handle string, offset uint64, data string) *sftpBuffer {
+	p := &sftpPacket{}
+	p.uint32(1)
+	p.string(handle)
+	binary.Write(p, binary.BigEndian, offset)
+	p.string(data)
+	return &sftpBuffer{b: p.Bytes()}
+}
+
+// sftpPath is the body of a packet that only names a path or handle.
+func sftpPath(p string) *sftpBuffer {
+	pkt := &sftpPacket{}
+	pkt.uint32(1)
+	pkt.string(p)
+	return &sftpBuffer{b: pkt.Bytes()}
+}
+
+// sftpOpen is the body of an SSH_FXP_OPEN packet for writing.
+func sftpOpen(p string) *sftpBuffer {
+	pkt := &sftpPacket{}
+	pkt.uint32(1)
+	pkt.string(p)
+	pkt.uint32(sshFxfWrite)
+	pkt.uint32(0)
+	return &sftpBuffer{b: pkt.Bytes()}
+}
+
+// sftpReply splits the one reply in out into its type and the rest, after
+// the request id.
+func sftpReply(t *testing.T, out *bytes.Buffer) (byte, *sftpBuffer) {
+	b := out.Bytes()
+	out.Reset()
+	if len(b) < 9 {
+		t.Fatalf("short reply %q", b)
+	}
+	return b[4], &sftpBuffer{b: b[9:]}
+}
+
+type fakeConn struct {
+	ssh.ConnMetadata
+}
+
+func (fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+}
+
+func TestSftpLimits(t *testing.T) {
+	var out bytes.Buffer
+	ss := &session{server: &Server{}, conn: fakeConn{}, shell: NewShell(NewVFS().Clone(), "root")}
+	s := &sftpServer{ss: ss, rw: &out, handles: map[string]*sftpHandle{}}
+
+	var handles []string
+	for i := 0; i < maxSftpHandles; i++ {
+		s.handle(sshFxpOpen, sftpOpen("/tmp/f"))
+		typ, r := sftpReply(t, &out)
+		if typ != sshFxpHandle {
+			t.Fatalf("open %d: reply %d, want a handle", i, typ)
+		}
+		handles = append(handles, r.string())
+	}
+
+	s.handle(sshFxpOpen, sftpOpen("/tmp/f"))
+	if typ, r := sftpReply(t, &out); typ != sshFxpStatus || r.uint32() != sshFxFailure {
+		t.Errorf("open beyond the limit: reply %d", typ)
+	}
+	s.handle(sshFxpOpendir, sftpPath("/tmp"))
+	if typ, r := sftpReply(t, &out); typ != sshFxpStatus || r.uint32() != sshFxFailure {
+		t.Errorf("opendir beyond the limit: reply %d", typ)
+	}
+
+	// the files being written share the budget
+	steps := []struct {
+		handle string
+		offset uint64
+		code   uint32
+	}{
+		{handles[0], maxSftpBuffered / 2, sshFxOk},
+		{handles[1], maxSftpBuffered/2 - 8, sshFxOk},
+		{handles[2], 0, sshFxFailure},
+		{handles[1], 0, sshFxOk},
+	}
+	for i, st := range steps {
+		s.handle(sshFxpWrite, sftpWrite(st.handle, st.offset, "abcd"))
+		if _, r := sftpReply(t, &out); r.uint32() != st.code {
+			t.Errorf("write %d: wanted status %d", i, st.code)
+		}
+	}
+
+	// and closing one gives its share back
+	s.handle(sshFxpClose, sftpPath(handles[0]))
+	sftpReply(t, &out)
+	s.handle(sshFxpWrite, sftpWrite(handles[2], 0, "abcd"))
+	if _, r := sftpReply(t, &out); r.uint32() != sshFxOk {
+		t.Error("write after close failed")
+	}
+	s.handle(sshFxpOpen, sftpOpen("/tmp/g"))
+	if typ, _ := sftpReply(t, &out); typ != sshFxpHandle {
+		t.Errorf("open after close: reply %d, want a handle", typ)
+	}
+	// what handles[1] and handles[2] hold
+	if want := uint64(maxSftpBuffered / 2); s.buffered != want {
+		t.Errorf("%d bytes buffered, want %d", s.buffered, want)
+	}
+}
+
+func TestSftpWriteOffset(t *testing.T) {
+	tests := []struct {
+		offset uint64
+		code   uint32
+		size   int
+	}{
+		{0, sshFxOk, 4},
+		{10, sshFxOk, 14},
+		{maxUpload - 4, sshFxOk, maxUpload},
+		{maxUpload - 3, sshFxFailure, 0},
+		{maxUpload, sshFxFailure, 0},
+		{math.MaxUint64, sshFxFailure, 0},
+		{math.MaxUint64 - 2, sshFxFailure, 0},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		s := &sftpServer{ss: &session{shell: NewShell(NewVFS(), "root")}, rw: &out, handles: map[string]*sftpHandle{}}
+		h := &sftpHandle{path: "/tmp/x", write: true}
+		name, _ := s.newHandle(h)
+
+		if err := s.handle(sshFxpWrite, sftpWrite(name, tt.offset, "abcd")); err != nil {
+			t.Fatalf("offset %d: %s", tt.offset, err)
+		}
+
+		// length, type, id, then the status code
+		b := out.Bytes()
+		if len(b) < 13 || b[4] != sshFxpStatus {
+			t.Fatalf("offset %d: reply %q isn't a status", tt.offset, b)
+		}
+		if code := binary.BigEndian.Uint32(b[9:]); code != tt.code {
+			t.Errorf("offset %d: status %d, want %d", tt.offset, code, tt.code)
+		}
+		if len(h.data) != tt.size {
+			t.Errorf("offset %d: file is %d bytes, want %d", tt.offset, len(h.data), tt.size)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fakeHostname = "everbor"
+	fakeKernel   = "2.6.1-64-generic"
+)
+
+// Shell emulates enough of bash to keep an attacker busy. Every command is
+// implemented in-process against a VFS; nothing is ever run on the host.
+type Shell struct {
+	fs   *VFS
+	user string
+	home string
+	cwd  string
+
+	// Command is called with every command line before it is run.
+	Command func(line string)
+
+	// Capture is called with every URL an attacker tries to download.
+	Capture func(url string)
+}
+
+// NewShell starts user in their home directory on fs.
+func NewShell(fs *VFS, user string) *Shell {
+	home := "/home/" + user
+	if user == "root" {
+		home = "/root"
+	}
+	fs.MkdirAll(home)
+
+	return &Shell{
+		fs:   fs,
+		user: user,
+		home: home,
+		cwd:  home,
+		Capture: func(u string) {
+			log.Println("captured download", u)
+		},
+	}
+}
+
+func (sh *Shell) prompt() string {
+	dir := sh.cwd
+	if dir == sh.home {
+		dir = "~"
+	} else if strings.HasPrefix(dir, sh.home+"/") {
+		dir = "~" + dir[len(sh.home):]
+	}
+
+	sigil := "$"
+	if sh.user == "root" {
+		sigil = "#"
+	}
+
+	return fmt.Sprintf("%s@%s:%s%s ", sh.user, fakeHostname, dir, sigil)
+}
+
+// Run reads command lines from rw, which should be a terminal, until the
+// attacker exits or hangs up.
+func (sh *Shell) Run(rw io.ReadWriter) int {
+	br := bufio.NewReader(rw)
+	status := 0
+
+	for {
+		io.WriteString(rw, sh.prompt())
+
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return status
+		}
+
+		var exit bool
+		if status, exit = sh.Exec(rw, line); exit {
+			return status
+		}
+	}
+}
+
+// abs resolves p against the working directory.
+func (sh *Shell) abs(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = sh.home + p[1:]
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(sh.cwd, p)
+	}
+	return path.Clean(p)
+}
+
+// token is a word or, when op is set, an unquoted shell operator.
+type token struct {
+	s  string
+	op bool
+}
+
+// tokenize splits a command line into words and the operators
+// ; && || | > and >>, honouring quotes and backslashes.
+func tokenize(line string) []token {
+	var toks []token
+	var word bytes.Buffer
+	inword := false
+	var quote byte
+
+	flush := func() {
+		if inword {
+			toks = append(toks, token{s: word.String()})
+			word.Reset()
+			inword = false
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' && i+1 < len(line) {
+				i++
+				word.WriteByte(line[i])
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inword = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			word.WriteByte(line[i])
+			inword = true
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			flush()
+		case c == ';':
+			flush()
+			toks = append(toks, token{";", true})
+		case c == '&' || c == '|' || c == '>':
+			flush()
+			if i+1 < len(line) && line[i+1] == c {
+				toks = append(toks, token{string([]byte{c, c}), true})
+				i++
+			} else {
+				toks = append(toks, token{string(c), true})
+			}
+		default:
+			word.WriteByte(c)
+			inword = true
+		}
+	}
+	flush()
+
+	return toks
+}
+
+// Exec runs a command line, writing its output to w. It returns the exit
+// status of the last command and whether the shell should exit.
+func (sh *Shell) Exec(w io.Writer, line string) (status int, exit bool) {
+	if line = strings.TrimSpace(line); line != "" && sh.Command != nil {
+		sh.Command(line)
+	}
+
+	toks := tokenize(line)
+	cond := ";"
+
+	for len(toks) > 0 {
+		// split off the next pipeline
+		i := 0
+		for i < len(toks) && !(toks[i].op && (toks[i].s == ";" || toks[i].s == "&&" || toks[i].s == "||" || toks[i].s == "&")) {
+			i++
+		}
+		pipeline := toks[:i]
+		next := ";"
+		if i < len(toks) {
+			next = toks[i].s
+			i++
+		}
+		toks = toks[i:]
+
+		if (cond == "&&" && status != 0) || (cond == "||" && status == 0) {
+			cond = next
+			continue
+		}
+		cond = next
+
+		if len(pipeline) == 0 {
+			continue
+		}
+
+		if status, exit = sh.pipeline(w, pipeline); exit {
+			return status, true
+		}
+	}
+
+	return status, false
+}
+
+// pipeline runs commands separated by | feeding each one's output to the next.
+func (sh *Shell) pipeline(w io.Writer, toks []token) (status int, exit bool) {
+	var in []byte
+
+	for len(toks) > 0 {
+		i := 0
+		for i < len(toks) && !(toks[i].op && toks[i].s == "|") {
+			i++
+		}
+		stage := toks[:i]
+		last := i == len(toks)
+		if !last {
+			i++
+		}
+		toks = toks[i:]
+
+		var args []string
+		var redirect string
+		var appnd bool
+
+		for j := 0; j < len(stage); j++ {
+			t := stage[j]
+			if t.op && (t.s == ">" || t.s == ">>") {
+				appnd = t.s == ">>"
+				if j+1 < len(stage) {
+					redirect = stage[j+1].s
+					j++
+				}
+				continue
+			}
+			args = append(args, t.s)
+		}
+
+		var out bytes.Buffer
+		if len(args) > 0 {
+			status, exit = sh.command(&out, args, in)
+		}
+
+		if redirect != "" {
+			p := sh.abs(redirect)
+			b := out.Bytes()
+			var err error
+			if appnd {
+				old, _ := sh.fs.ReadFile(p)
+				if len(old)+len(b) > maxFileSize {
+					// don't even build what would be refused
+					err = errTooBig
+				} else {
+					b = append(append([]byte{}, old...), b...)
+				}
+			}
+			if err == nil {
+				err = sh.fs.WriteFile(p, b)
+			}
+			if err != nil {
+				fmt.Fprintf(w, "-bash: %s: %s\n", redirect, err)
+				status = 1
+			}
+			out.Reset()
+		}
+
+		if last || exit {
+			w.Write(out.Bytes())
+			return status, exit
+		}
+		in = out.Bytes()
+	}
+
+	return status, exit
+}
+
+// builtin is an emulated command; in holds piped input, if any.
+type builtin func(sh *Shell, w io.Writer, args []string, in []byte) int
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"cat":    (*Shell).cat,
+		"cd":     (*Shell).cd,
+		"curl":   (*Shell).curl,
+		"echo":   (*Shell).echo,
+		"id":     (*Shell).id,
+		"ls":     (*Shell).ls,
+		"ps":     (*Shell).ps,
+		"pwd":    (*Shell).pwd,
+		"uname":  (*Shell).uname,
+		"wget":   (*Shell).wget,
+		"whoami": (*Shell).whoami,
+	}
+}
+
+func (sh *Shell) command(w io.Writer, args []string, in []byte) (status int, exit bool) {
+	name := args[0]
+
+	if name == "exit" || name == "logout" {
+		if len(args) > 1 {
+			status, _ = strconv.Atoi(args[1])
+		}
+		return status, true
+	}
+
+	fn, ok := builtins[path.Base(name)]
+	if !ok {
+		fmt.Fprintf(w, "-bash: %s: command not found\n", name)
+		return 127, false
+	}
+
+	return fn(sh, w, args[1:], in), false
+}
+
+// flags separates leading single-dash options from operands.
+func flags(args []string) (string, []string) {
+	var opts string
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		opts += args[0][1:]
+		args = args[1:]
+	}
+	return opts, args
+}
+
+func (sh *Shell) cat(w io.Writer, args []string, in []byte) int {
+	_, args = flags(args)
+	if len(args) == 0 {
+		w.Write(in)
+		return 0
+	}
+
+	status := 0
+	for _, a := range args {
+		b, err := sh.fs.ReadFile(sh.abs(a))
+		if err != nil {
+			fmt.Fprintf(w, "cat: %s: %s\n", a, err)
+			status = 1
+			continue
+		}
+		w.Write(b)
+	}
+	return status
+}
+
+func (sh *Shell) cd(w io.Writer, args []string, in []byte) int {
+	name, dir := sh.home, sh.home
+	if len(args) > 0 {
+		name, dir = args[0], sh.abs(args[0])
+	}
+
+	n, err := sh.fs.Stat(dir)
+	if err == nil && n.children == nil {
+		err = errNotDir
+	}
+	if err != nil {
+		fmt.Fprintf(w, "-bash: cd: %s: %s\n", name, err)
+		return 1
+	}
+
+	sh.cwd = dir
+	return 0
+}
+
+func (sh *Shell) echo(w io.Writer, args []string, in []byte) int {
+	newline := true
+	if len(args) > 0 && args[0] == "-n" {
+		newline = false
+		args = args[1:]
+	}
+
+	io.WriteString(w, strings.Join(args, " "))
+	if newline {
+		io.WriteString(w, "\n")
+	}
+	return 0
+}
+
+func (sh *Shell) id(w io.Writer, args []string, in []byte) int {
+	if sh.user == "root" {
+		io.WriteString(w, "uid=0(root) gid=0(root) groups=0(root)\n")
+	} else {
+		fmt.Fprintf(w, "uid=1000(%s) gid=1000(%s) groups=1000(%s)\n", sh.user, sh.user, sh.user)
+	}
+	return 0
+}
+
+func (sh *Shell) ls(w io.Writer, args []string, in []byte) int {
+	opts, args := flags(args)
+	long := strings.Contains(opts, "l")
+	all := strings.Contains(opts, "a")
+
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	status := 0
+	for _, a := range args {
+		p := sh.abs(a)
+		n, err := sh.fs.Stat(p)
+		if err != nil {
+			fmt.Fprintf(w, "ls: cannot access %s: %s\n", a, err)
+			status = 2
+			continue
+		}
+
+		entries := []*vnode{n}
+		if n.children != nil {
+			entries, _ = sh.fs.ReadDir(p)
+		}
+
+		var names []string
+		for _, e := range entries {
+			if !all && strings.HasPrefix(e.name, ".") {
+				continue
+			}
+			name := e.name
+			if n.children == nil {
+				name = a
+			}
+			if long {
+				fmt.Fprintf(w, "%s 1 %-8s %-8s %8d %s %s\n", e.mode, sh.user, sh.user, len(e.data), e.modTime.Format("Jan _2 15:04"), name)
+			} else {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			io.WriteString(w, strings.Join(names, "  ")+"\n")
+		}
+	}
+	return status
+}
+
+func (sh *Shell) ps(w io.Writer, args []string, in []byte) int {
+	io.WriteString(w, "  PID TTY          TIME CMD\n")
+	io.WriteString(w, " 2318 pts/0    00:00:00 bash\n")
+	io.WriteString(w, " 2371 pts/0    00:00:00 ps\n")
+	return 0
+}
+
+func (sh *Shell) pwd(w io.Writer, args []string, in []byte) int {
+	io.WriteString(w, sh.cwd+"\n")
+	return 0
+}
+
+func (sh *Shell) uname(w io.Writer, args []string, in []byte) int {
+	opts, _ := flags(args)
+
+	fields := map[byte]string{
+		's': "Linux",
+		'n': fakeHostname,
+		'r': fakeKernel,
+		'v': "#1 SMP Mon Jun 15 13:04:32 UTC 2015",
+		'm': "x86_64",
+		'o': "GNU/Linux",
+	}
+
+	if strings.Contains(opts, "a") {
+		opts = "snrvmo"
+	} else if opts == "" {
+		opts = "s"
+	}
+
+	var out []string
+	for i := 0; i < len(opts); i++ {
+		if f, ok := fields[opts[i]]; ok {
+			out = append(out, f)
+		}
+	}
+
+	io.WriteString(w, strings.Join(out, " ")+"\n")
+	return 0
+}
+
+func (sh *Shell) whoami(w io.Writer, args []string, in []byte) int {
+	io.WriteString(w, sh.user+"\n")
+	return 0
+}
+
+// download records the first URL in args and returns its host.
+func (sh *Shell) download(args []string) (string, bool) {
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			continue
+		}
+		raw := a
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		sh.Capture(raw)
+		return u.Host, true
+	}
+	return "", false
+}
+
+func (sh *Shell) wget(w io.Writer, args []string, in []byte) int {
+	host, ok := sh.download(args)
+	if !ok {
+		io.WriteString(w, "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n")
+		return 1
+	}
+
+	fmt.Fprintf(w, "--%s--  %s\n", time.Now().Format("2006-01-02 15:04:05"), args[len(args)-1])
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if net.ParseIP(host) != nil {
+		fmt.Fprintf(w, "Connecting to %s:80... failed: Connection timed out.\n", host)
+	} else {
+		fmt.Fprintf(w, "Resolving %s (%s)... failed: Temporary failure in name resolution.\n", host, host)
+		fmt.Fprintf(w, "wget: unable to resolve host address '%s'\n", host)
+	}
+	return 4
+}
+
+func (sh *Shell) curl(w io.Writer, args []string, in []byte) int {
+	host, ok := sh.download(args)
+	if !ok {
+		io.WriteString(w, "curl: try 'curl --help' or 'curl --manual' for more information\n")
+		return 2
+	}
+
+	fmt.Fprintf(w, "curl: (6) Could not resolve host: %s\n", host)
+	return 6
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCdErrors(t *testing.T) {
+	fs := NewVFS()
+	// a home that can't be a directory, as a loaded filesystem might have
+	if err := fs.WriteFile("/home/bob", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	sh := NewShell(fs, "bob")
+	sh.cwd = "/tmp"
+
+	tests := []struct {
+		line, want string
+	}{
+		{"cd\n", "-bash: cd: /home/bob: Not a directory\n"},
+		{"cd nowhere\n", "-bash: cd: nowhere: No such file or directory\n"},
+		{"cd /etc/passwd\n", "-bash: cd: /etc/passwd: Not a directory\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if status, _ := sh.Exec(&out, tt.line); status != 1 || out.String() != tt.want {
+			t.Errorf("%q: status %d, output %q, want %q", tt.line, status, out.String(), tt.want)
+		}
+		if sh.cwd != "/tmp" {
+			t.Errorf("%q: moved to %s", tt.line, sh.cwd)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// maxUpload is the largest file accepted over scp or sftp.
+const maxUpload = 64 << 20
+
+// upload stores a file pushed by the attacker: it appears in the session's
+// filesystem and a copy is quarantined, named by its SHA-256, for analysis.
+func (ss *session) upload(method, name string, data []byte) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	log.Printf("%s uploaded %s (%d bytes, sha256 %s) via %s", ss.conn.RemoteAddr(), name, len(data), hash, method)
+
+	ss.shell.fs.WriteFile(name, data)
+
+	e := Event{Type: EventUpload, Method: method, File: name, SHA256: hash, Size: int64(len(data))}
+	if err := ss.server.quarantine(hash, data); err != nil {
+		log.Println("could not quarantine upload:", err)
+		e.Error = err.Error()
+	}
+	ss.server.emit(ss.conn.RemoteAddr(), e)
+}
+
+// quarantine saves data under its hash unless a copy is already there.
+func (s *Server) quarantine(hash string, data []byte) error {
+	if s.QuarantineDir == "" {
+		return nil
+	}
+
+	path := filepath.Join(s.QuarantineDir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(s.QuarantineDir, ".upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	// never leave a sample executable
+	os.Chmod(tmp.Name(), 0440)
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNotExist = errors.New("No such file or directory")
+	errNotDir   = errors.New("Not a directory")
+	errIsDir    = errors.New("Is a directory")
+	errTooBig   = errors.New("File too large")
+	errNoSpace  = errors.New("No space left on device")
+)
+
+// Limits on what is written to a session's copy of the filesystem, so that
+// appending to a file in a loop can't use up the host's memory.
+const (
+	maxFileSize  = maxUpload
+	maxVFSGrowth = 2 * maxUpload
+)
+
+// vnode is a file or directory in a VFS.
+type vnode struct {
+	name     string
+	mode     os.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*vnode
+}
+
+// snapshot copies what a caller may look at once fs.mu is released. A
+// directory's children are left out, though its children map isn't nil.
+func (n *vnode) snapshot() *vnode {
+	c := *n
+	if n.children != nil {
+		c.children = map[string]*vnode{}
+	}
+	return &c
+}
+
+func (n *vnode) clone() *vnode {
+	c := *n
+	if n.children != nil {
+		c.children = make(map[string]*vnode, len(n.children))
+		for k, v := range n.children {
+			c.children[k] = v.clone()
+		}
+	}
+	return &c
+}
+
+// VFS is an in-memory filesystem shown to attackers in place of the host's.
+// It is shared by all the channels of a connection.
+type VFS struct {
+	mu    sync.Mutex
+	root  *vnode
+	size  int64 // bytes in all the files
+	limit int64 // the most size may grow to, 0 for no limit
+}
+
+func newDir(name string) *vnode {
+	return &vnode{name: name, mode: os.ModeDir | 0755, modTime: time.Now(), children: map[string]*vnode{}}
+}
+
+// NewVFS returns a minimal filesystem that looks like a fresh server install.
+func NewVFS() *VFS {
+	fs := &VFS{root: newDir("/")}
+
+	for _, d := range []string{"/bin", "/boot", "/dev", "/etc", "/home", "/proc", "/root", "/sbin", "/tmp", "/usr/bin", "/usr/sbin", "/var/log", "/var/tmp"} {
+		if err := fs.MkdirAll(d); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, f := range []struct{ name, data string }{
+		{"/etc/hostname", fakeHostname + "\n"},
+		{"/etc/issue", "Ubuntu 14.04.2 LTS \\n \\l\n\n"},
+		{"/etc/passwd", "root:x:0:0:root:/root:/bin/bash\n" +
+			"daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin\n" +
+			"bin:x:2:2:bin:/bin:/usr/sbin/nologin\n" +
+			"sys:x:3:3:sys:/dev:/usr/sbin/nologin\n" +
+			"www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin\n" +
+			"sshd:x:104:65534::/var/run/sshd:/usr/sbin/nologin\n"},
+		{"/proc/version", "Linux version " + fakeKernel + " (buildd@lgw01-04) (gcc version 4.8.2 (Ubuntu 4.8.2-19ubuntu1)) #1 SMP\n"},
+		{"/proc/cpuinfo", "processor\t: 0\nvendor_id\t: GenuineIntel\nmodel name\t: Intel(R) Xeon(R) CPU E5-2630 v2 @ 2.60GHz\ncpu MHz\t\t: 2600.000\ncache size\t: 15360 KB\n\n"},
+		{"/root/.bash_history", ""},
+	} {
+		if err := fs.WriteFile(f.name, []byte(f.data)); err != nil {
+			panic(err)
+		}
+	}
+
+	return fs
+}
+
+// LoadVFS seeds a filesystem from a directory or a (gzipped) tarball.
+func LoadVFS(src string) (*VFS, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return loadDir(src)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(src, ".gz") || strings.HasSuffix(src, ".tgz") {
+		if r, err = gzip.NewReader(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return loadTar(r)
+}
+
+func loadDir(src string) (*VFS, error) {
+	fs := &VFS{root: newDir("/")}
+
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(src, p)
+		name := "/" + filepath.ToSlash(rel)
+
+		switch {
+		case fi.IsDir():
+			fs.MkdirAll(name)
+		case fi.Mode().IsRegular():
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			fs.WriteFile(name, b)
+		default:
+			return nil
+		}
+
+		fs.setInfo(name, fi.Mode(), fi.ModTime())
+
+		return nil
+	})
+
+	return fs, err
+}
+
+func loadTar(r io.Reader) (*VFS, error) {
+	fs := &VFS{root: newDir("/")}
+	tr := tar.NewReader(r)
+
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return fs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean("/" + h.Name)
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			fs.MkdirAll(name)
+		case tar.TypeReg, tar.TypeRegA:
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			fs.MkdirAll(path.Dir(name))
+			fs.WriteFile(name, b)
+		default:
+			continue
+		}
+
+		fs.setInfo(name, h.FileInfo().Mode(), h.ModTime)
+	}
+}
+
+// Clone returns a deep copy so that each session can scribble on its own,
+// though only within maxFileSize and maxVFSGrowth.
+func (fs *VFS) Clone() *VFS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return &VFS{root: fs.root.clone(), size: fs.size, limit: fs.size + maxVFSGrowth}
+}
+
+// Stat returns a snapshot of the file or directory at p.
+func (fs *VFS) Stat(p string) (*vnode, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return n.snapshot(), nil
+}
+
+// setInfo sets the mode and modification time of the file or directory at
+// p, if there is one.
+func (fs *VFS) setInfo(p string, mode os.FileMode, modTime time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if n, err := fs.lookup(p); err == nil {
+		n.mode = mode
+		n.modTime = modTime
+	}
+}
+
+// lookup resolves an absolute, slash-separated path; fs.mu must be held.
+func (fs *VFS) lookup(p string) (*vnode, error) {
+	n := fs.root
+	for _, part := range strings.Split(path.Clean(p), "/") {
+		if part == "" {
+			continue
+		}
+		if n.children == nil {
+			return nil, errNotDir
+		}
+		c, ok := n.children[part]
+		if !ok {
+			return nil, errNotExist
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// MkdirAll creates the directory p along with any missing parents.
+func (fs *VFS) MkdirAll(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := fs.root
+	for _, part := range strings.Split(path.Clean(p), "/") {
+		if part == "" {
+			continue
+		}
+		if n.children == nil {
+			return errNotDir
+		}
+		c, ok := n.children[part]
+		if !ok {
+			c = newDir(part)
+			n.children[part] = c
+		}
+		n = c
+	}
+	if n.children == nil {
+		return errNotDir
+	}
+	return nil
+}
+
+// ReadFile returns the contents of the file at p.
+func (fs *VFS) ReadFile(p string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if n.children != nil {
+		return nil, errIsDir
+	}
+	return n.data, nil
+}
+
+// WriteFile replaces the file at p, creating it in an existing directory.
+func (fs *VFS) WriteFile(p string, data []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p = path.Clean(p)
+	dir, err := fs.lookup(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	if dir.children == nil {
+		return errNotDir
+	}
+
+	name := path.Base(p)
+	n, ok := dir.children[name]
+	if ok && n.children != nil {
+		return errIsDir
+	}
+
+	var old int64
+	if ok {
+		old = int64(len(n.data))
+	}
+	size := fs.size - old + int64(len(data))
+	if fs.limit > 0 {
+		if len(data) > maxFileSize {
+			return errTooBig
+		}
+		if size > fs.limit {
+			return errNoSpace
+		}
+	}
+	fs.size = size
+
+	if ok {
+		n.data = data
+		n.modTime = time.Now()
+		return nil
+	}
+
+	dir.children[name] = &vnode{name: name, mode: 0644, modTime: time.Now(), data: data}
+	return nil
+}
+
+// ReadDir lists snapshots of the directory at p sorted by name.
+func (fs *VFS) ReadDir(p string) ([]*vnode, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if n.children == nil {
+		return nil, errNotDir
+	}
+
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ns := make([]*vnode, len(names))
+	for i, name := range names {
+		ns[i] = n.children[name].snapshot()
+	}
+	return ns, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVFSLimits(t *testing.T) {
+	big := make([]byte, maxFileSize)
+	fs := NewVFS().Clone()
+
+	steps := []struct {
+		name string
+		size int
+		err  error
+	}{
+		{"/tmp/a", maxFileSize, nil},
+		{"/tmp/b", maxFileSize + 1, errTooBig},
+		{"/tmp/b", maxFileSize, nil},
+		{"/tmp/c", 1, errNoSpace},
+		// overwriting a file gives back what it held
+		{"/tmp/a", 0, nil},
+		{"/tmp/c", 1, nil},
+	}
+	for _, s := range steps {
+		data := big
+		if s.size > maxFileSize {
+			data = make([]byte, s.size)
+		}
+		if err := fs.WriteFile(s.name, data[:s.size]); err != s.err {
+			t.Errorf("writing %d bytes to %s: %v, want %v", s.size, s.name, err, s.err)
+		}
+	}
+
+	// only sessions' copies are limited
+	if err := NewVFS().WriteFile("/tmp/a", make([]byte, maxFileSize+1)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedirectLimit(t *testing.T) {
+	fs := NewVFS().Clone()
+	if err := fs.WriteFile("/tmp/f", make([]byte, maxFileSize-2)); err != nil {
+		t.Fatal(err)
+	}
+	sh := NewShell(fs, "root")
+
+	var out bytes.Buffer
+	sh.Exec(&out, "echo a >> /tmp/f\n")
+	if status, _ := sh.Exec(&out, "echo a >> /tmp/f\n"); status != 1 || out.String() != "-bash: /tmp/f: File too large\n" {
+		t.Errorf("status %d, output %q", status, out.String())
+	}
+	if b, _ := fs.ReadFile("/tmp/f"); len(b) != maxFileSize {
+		t.Errorf("file is %d bytes, want %d", len(b), maxFileSize)
+	}
+}
+
+func TestVFSSnapshots(t *testing.T) {
+	fs := NewVFS()
+	if err := fs.WriteFile("/tmp/a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := fs.Stat("/tmp/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir("/tmp")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("%v, %v", entries, err)
+	}
+	dir, err := fs.Stat("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// done while another channel of the connection might be looking
+	fs.WriteFile("/tmp/a", []byte("newer"))
+	fs.WriteFile("/tmp/b", nil)
+
+	if string(n.data) != "old" || string(entries[0].data) != "old" {
+		t.Errorf("snapshots changed to %q and %q", n.data, entries[0].data)
+	}
+	if dir.children == nil || len(dir.children) != 0 {
+		t.Errorf("directory snapshot has children %v", dir.children)
+	}
+}